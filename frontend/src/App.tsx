@@ -24,7 +24,10 @@ export default function App() {
   }
 
   const onLogout = () => {
+    // end the session server-side so its refresh token stops working
+    if (token) api.post('/auth/logout', {}).catch(() => {})
     localStorage.removeItem('token')
+    localStorage.removeItem('refresh_token')
     localStorage.removeItem('user_id')
     setToken(null)
     setUserId(null)
@@ -46,7 +49,7 @@ export default function App() {
           <div className="text-xl font-bold">Chat</div>
           {me && (
             <div className="flex items-center gap-2 text-sm text-gray-600">
-              <img src={me.AvatarURL || me.avatar_url || '/static/avatars/default.png'} className="w-8 h-8 rounded-full object-cover" />
+              <img src={me.AvatarURL || me.avatar_url || `/avatar/${me.ID}?size=64`} className="w-8 h-8 rounded-full object-cover" />
               <div>{me.Name || me.name || 'Me'}</div>
             </div>
           )}
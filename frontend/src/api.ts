@@ -4,11 +4,49 @@ function getToken(): string | null {
   return localStorage.getItem('token')
 }
 
-async function request(path: string, opts: RequestInit = {}) {
+// one refresh at a time: a refresh token works once, so concurrent
+// requests that hit a 401 share the same exchange, and tabs take turns
+// through a lock so they never present the same token twice
+let refreshing: Promise<boolean> | null = null
+
+export function refreshAccessToken(stale: string | null): Promise<boolean> {
+  if (!refreshing) {
+    const run = async () => {
+      // another tab refreshed while we waited for the lock
+      if (localStorage.getItem('token') !== stale) return true
+      const refreshToken = localStorage.getItem('refresh_token')
+      if (!refreshToken) return false
+      const res = await fetch('/auth/refresh', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ refresh_token: refreshToken }),
+      })
+      if (!res.ok) {
+        localStorage.removeItem('refresh_token')
+        return false
+      }
+      const body = await res.json()
+      localStorage.setItem('token', body.token)
+      localStorage.setItem('refresh_token', body.refresh_token)
+      return true
+    }
+    refreshing = (navigator.locks ? navigator.locks.request('chat-token-refresh', run) : run())
+      .catch(() => false)
+      .finally(() => {
+        refreshing = null
+      })
+  }
+  return refreshing
+}
+
+async function request(path: string, opts: RequestInit = {}, retry = true): Promise<any> {
   const headers = new Headers(opts.headers || undefined)
   const token = getToken()
   if (token) headers.set('Authorization', `Bearer ${token}`)
   const res = await fetch(path, { ...opts, headers })
+  if (res.status === 401 && retry && token && (await refreshAccessToken(token))) {
+    return request(path, opts, false)
+  }
   const text = await res.text()
   let body: any = {}
   try {
@@ -12,7 +12,7 @@ export default function Chat({ token, userId, onLogout }: { token?: string | nul
   const seenRef = useRef<Set<string>>(new Set())
 
   useEffect(() => {
-    api.get('/userList').then((b) => setUsers(b.data || [])).catch(() => setUsers([]))
+    api.get('/users?limit=200').then((b) => setUsers(b.data || [])).catch(() => setUsers([]))
   }, [])
 
   // load history when selecting a user
@@ -33,8 +33,13 @@ export default function Chat({ token, userId, onLogout }: { token?: string | nul
   }, [selectedUser])
 
   useEffect(() => {
+    // the socket needs a JWT
+    if (!token) {
+      setConnectionStatus('disconnected')
+      return
+    }
     setConnectionStatus('connecting')
-    const ws = createSocket({ token: token || undefined, userId: userId })
+    const ws = createSocket({ token })
     wsRef.current = ws
     ws.onopen = () => {
       setConnectionStatus('connected')
@@ -43,6 +48,10 @@ export default function Chat({ token, userId, onLogout }: { token?: string | nul
     ws.onmessage = (ev: MessageEvent) => {
       try {
         const m: Message = JSON.parse(ev.data)
+        // ack direct messages addressed to us so the server stops replaying them
+        if (m.id && m.type !== 'ack' && userId && m.to === userId) {
+          ws.send(JSON.stringify({ type: 'ack', id: m.id }))
+        }
         // dedupe logic
         const key = m.id ? `id:${m.id}` : `msg:${m.from}:${m.to}:${m.body}`
         setMessages((prev) => {
@@ -76,7 +85,8 @@ export default function Chat({ token, userId, onLogout }: { token?: string | nul
   const send = () => {
     if (!wsRef.current) return
     if (!selectedUser) return
-    const m: Message = { type: 'message', to: selectedUser, body: input }
+    // client_msg_id lets the server drop retries of this send
+    const m: Message = { type: 'message', to: selectedUser, body: input, client_msg_id: crypto.randomUUID() }
     wsRef.current.send(JSON.stringify(m))
     // optimistic UI: add message without id
     const optimistic: Message = { ...m, from: userId }
@@ -102,9 +112,9 @@ export default function Chat({ token, userId, onLogout }: { token?: string | nul
         </div>
         <div className="space-y-2">
           {users.map((u: any) => (
-            <div key={u.ID || u.id} className={`p-2 rounded cursor-pointer ${selectedUser === u.ID ? 'bg-blue-100' : 'hover:bg-gray-100'}`} onClick={() => setSelectedUser(u.ID)}>
-              <div className="font-semibold">{u.Name || u.name || `user:${u.ID}`}</div>
-              <div className="text-xs text-gray-500">id: {u.ID}</div>
+            <div key={u.id} className={`p-2 rounded cursor-pointer ${selectedUser === u.id ? 'bg-blue-100' : 'hover:bg-gray-100'}`} onClick={() => setSelectedUser(u.id)}>
+              <div className="font-semibold">{u.name || `user:${u.id}`}</div>
+              <div className="text-xs text-gray-500">id: {u.id} · {u.presence?.status || 'offline'}</div>
             </div>
           ))}
         </div>
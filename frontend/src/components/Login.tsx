@@ -18,6 +18,7 @@ export default function Login({ onLogin }: { onLogin: (token?: string, userId?:
       const userId = (body as any).user_id || (body as any).data?.user_id
       if (token) {
         localStorage.setItem('token', token)
+        if ((body as any).refresh_token) localStorage.setItem('refresh_token', (body as any).refresh_token)
         onLogin(token, undefined)
       } else if (userId) {
         localStorage.setItem('user_id', String(userId))
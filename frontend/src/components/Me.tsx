@@ -60,7 +60,7 @@ export default function Me({ onProfileUpdate }: { onProfileUpdate?: (u: any) =>
       {profile ? (
         <div className="space-y-3">
           <div className="flex items-center gap-3">
-            <img src={avatarPreview || '/static/avatars/default.png'} alt="avatar" className="w-16 h-16 rounded-full object-cover" />
+            <img src={avatarPreview || `/avatar/${profile.ID}`} alt="avatar" className="w-16 h-16 rounded-full object-cover" />
             <div>
               <div className="text-sm text-gray-500">ID: {profile.ID}</div>
               <div className="text-lg font-medium">{profile.Name || profile.name}</div>
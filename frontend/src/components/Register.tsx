@@ -24,6 +24,7 @@ export default function Register({ onRegister, onCancel }: { onRegister: (token?
       const userId = (body as any).user_id || (body as any).data?.user_id
       if (token) {
         localStorage.setItem('token', token)
+        if ((body as any).refresh_token) localStorage.setItem('refresh_token', (body as any).refresh_token)
         onRegister(token, undefined)
       } else if (userId) {
         localStorage.setItem('user_id', String(userId))
@@ -4,20 +4,25 @@ export type Message = {
   to?: number
   id?: number
   body?: string
+  seq?: number
+  client_msg_id?: string
 }
 
-export function createSocket(opts: { token?: string; userId?: number }) {
+export function createSocket(opts: { token: string }) {
   const protocol = location.protocol === 'https:' ? 'wss' : 'ws'
   // use explicit backend port 8080 (same as server)
-  let url = `${protocol}://${location.hostname}:8080/ws`
-  if (opts.token) url += `?token=${encodeURIComponent(opts.token)}`
-  else if (opts.userId) url += `?user_id=${opts.userId}`
+  const base = `${protocol}://${location.hostname}:8080/ws`
+  // reconnects pick up the access token api.ts stored after a refresh
+  const socketUrl = () => `${base}?token=${encodeURIComponent(localStorage.getItem('token') || opts.token)}`
 
   // WebSocket wrapper with reconnection, backoff and outgoing buffer.
   let ws: WebSocket | null = null
   let reconnectAttempts = 0
   let reconnectTimer: number | null = null
   const sendBuffer: Array<string> = []
+  // last per-user sequence received; sent as resume_from on reconnect so the
+  // server replays exactly the frames we missed
+  let lastSeq = 0
 
   // public-facing handlers (assignable)
   const wrapper: any = {
@@ -48,7 +53,9 @@ export function createSocket(opts: { token?: string; userId?: number }) {
   }
 
   function connect() {
-    ws = new WebSocket(url)
+    let connectUrl = socketUrl()
+    if (lastSeq > 0) connectUrl += `${connectUrl.includes('?') ? '&' : '?'}resume_from=${lastSeq}`
+    ws = new WebSocket(connectUrl)
     ws.onopen = (ev) => {
       reconnectAttempts = 0
       wrapper.connected = true
@@ -66,6 +73,14 @@ export function createSocket(opts: { token?: string; userId?: number }) {
       if (typeof wrapper.onopen === 'function') wrapper.onopen(ev)
     }
     ws.onmessage = (ev) => {
+      try {
+        const m = JSON.parse(ev.data)
+        // the server lost our session: start counting again
+        if (m.type === 'resync') lastSeq = 0
+        else if (typeof m.seq === 'number' && m.seq > lastSeq) lastSeq = m.seq
+      } catch (e) {
+        // not JSON; leave it to the handler
+      }
       if (typeof wrapper.onmessage === 'function') wrapper.onmessage(ev)
     }
     ws.onclose = (ev) => {
@@ -9,6 +9,14 @@ export default defineConfig({
         changeOrigin: true,
         secure: false,
       },
+      '/avatar': {
+        target: 'http://localhost:8080',
+        changeOrigin: true,
+      },
+      '/auth': {
+        target: 'http://localhost:8080',
+        changeOrigin: true,
+      },
       '/ws': {
         target: 'ws://localhost:8080',
         ws: true,
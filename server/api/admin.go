@@ -0,0 +1,227 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"chat/model"
+	"chat/service"
+	"chat/ws"
+)
+
+// adminError maps account administration errors to HTTP responses.
+func adminError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrSelfSuspend):
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Cannot suspend yourself", "error": "SELF_SUSPEND"})
+	case errors.Is(err, service.ErrNotSuspended):
+		c.JSON(http.StatusConflict, gin.H{"message": "Account not suspended", "error": "NOT_SUSPENDED"})
+	case errors.Is(err, service.ErrRoleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": "Role not found", "error": "ROLE_NOT_FOUND"})
+	case errors.Is(err, service.ErrForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"message": "Forbidden", "error": "FORBIDDEN"})
+	case err.Error() == "user not found":
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found", "error": "USER_NOT_FOUND"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Admin operation failed", "error": err.Error()})
+	}
+}
+
+// adminTarget returns the acting operator and the account named by the id
+// path parameter.
+func adminTarget(c *gin.Context) (actor, target uint, ok bool) {
+	if actor, ok = currentUserID(c); !ok {
+		return
+	}
+	target, ok = pathID(c, "id")
+	return
+}
+
+// adminManage is adminTarget for actions that need the operator to be
+// allowed to manage the target account. A denial is audited.
+func adminManage(c *gin.Context, action string) (actor, target uint, ok bool) {
+	if actor, target, ok = adminTarget(c); !ok {
+		return
+	}
+	if err := service.CanManageUser(actor, target); err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			service.AuditDenied(actor, action, target, "target outranks the operator", c.ClientIP())
+		}
+		adminError(c, err)
+		return 0, 0, false
+	}
+	return actor, target, true
+}
+
+// AdminListUsers godoc
+// @Summary List accounts
+// @Description Requires user.manage. Newest first; pass next_cursor as before to continue.
+// @Tags Admin
+// @Produce json
+// @Param before query int false "Only accounts with a smaller id"
+// @Param limit query int false "Page size, default 50, max 200"
+// @Param suspended query bool false "Only suspended accounts"
+// @Success 200 {object} map[string]interface{}
+// @Router /admin/users [get]
+func AdminListUsers(c *gin.Context) {
+	before, limit, ok := pageQuery(c)
+	if !ok {
+		return
+	}
+	users, hasMore, err := service.AdminListUsers(before, limit, c.Query("suspended") == "true")
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	var next interface{}
+	if hasMore {
+		next = users[len(users)-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": users, "has_more": hasMore, "next_cursor": next})
+}
+
+// AdminSuspendUser godoc
+// @Summary Suspend an account
+// @Description Requires user.manage and every permission the user holds; suspending an admin requires being one. The user's tokens are revoked and open connections closed.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param id path int true "User id"
+// @Param request body map[string]interface{} false "Suspension {reason}"
+// @Success 200 {object} map[string]interface{}
+// @Router /admin/users/{id}/suspend [post]
+func AdminSuspendUser(c *gin.Context) {
+	actor, target, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	// the body is optional
+	_ = c.ShouldBindJSON(&req)
+	if err := service.SuspendUser(actor, target); err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			service.AuditDenied(actor, "user.suspend", target, "target outranks the operator", c.ClientIP())
+		}
+		adminError(c, err)
+		return
+	}
+	service.Audit(actor, "user.suspend", target, model.AuditAllowed, req.Reason, c.ClientIP())
+	ws.DefaultHub.Logout(target)
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+// AdminRestoreUser godoc
+// @Summary Lift the suspension of an account
+// @Description Requires user.manage and every permission the user holds. Tokens revoked by the suspension stay revoked.
+// @Tags Admin
+// @Produce json
+// @Param id path int true "User id"
+// @Success 200 {object} map[string]interface{}
+// @Router /admin/users/{id}/restore [post]
+func AdminRestoreUser(c *gin.Context) {
+	actor, target, ok := adminManage(c, "user.restore")
+	if !ok {
+		return
+	}
+	if err := service.RestoreUser(target); err != nil {
+		adminError(c, err)
+		return
+	}
+	service.Audit(actor, "user.restore", target, model.AuditAllowed, "", c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+// AdminLogoutUser godoc
+// @Summary Log an account out everywhere
+// @Description Requires user.manage and every permission the user holds. Revokes every token issued so far and closes open connections.
+// @Tags Admin
+// @Produce json
+// @Param id path int true "User id"
+// @Success 200 {object} map[string]interface{}
+// @Router /admin/users/{id}/logout [post]
+func AdminLogoutUser(c *gin.Context) {
+	actor, target, ok := adminManage(c, "user.logout")
+	if !ok {
+		return
+	}
+	if err := service.RevokeTokens(target); err != nil {
+		adminError(c, err)
+		return
+	}
+	service.Audit(actor, "user.logout", target, model.AuditAllowed, "", c.ClientIP())
+	ws.DefaultHub.Logout(target)
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+// AdminListRoles godoc
+// @Summary List roles
+// @Description Requires role.manage.
+// @Tags Admin
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /admin/roles [get]
+func AdminListRoles(c *gin.Context) {
+	roles, err := service.ListRoles()
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": roles})
+}
+
+// AdminGrantRole godoc
+// @Summary Grant a role to an account
+// @Description Requires role.manage.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param id path int true "User id"
+// @Param request body map[string]interface{} true "Grant {role}"
+// @Success 200 {object} map[string]interface{}
+// @Router /admin/users/{id}/roles [post]
+func AdminGrantRole(c *gin.Context) {
+	actor, target, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request", "error": err.Error()})
+		return
+	}
+	if err := service.GrantRole(actor, target, req.Role); err != nil {
+		adminError(c, err)
+		return
+	}
+	service.Audit(actor, "role.grant", target, model.AuditAllowed, req.Role, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+// AdminRevokeRole godoc
+// @Summary Revoke a role from an account
+// @Description Requires role.manage.
+// @Tags Admin
+// @Produce json
+// @Param id path int true "User id"
+// @Param role path string true "Role name"
+// @Success 200 {object} map[string]interface{}
+// @Router /admin/users/{id}/roles/{role} [delete]
+func AdminRevokeRole(c *gin.Context) {
+	actor, target, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+	role := c.Param("role")
+	if err := service.RevokeRole(target, role); err != nil {
+		adminError(c, err)
+		return
+	}
+	service.Audit(actor, "role.revoke", target, model.AuditAllowed, role, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"chat/service"
+	"chat/storage"
+)
+
+// attachmentError maps attachment service errors to HTTP responses.
+func attachmentError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrAttachmentNotFound), errors.Is(err, storage.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": "Attachment not found", "error": "ATTACHMENT_NOT_FOUND"})
+	case errors.Is(err, service.ErrNotParticipant):
+		c.JSON(http.StatusForbidden, gin.H{"message": "Not a participant", "error": "NOT_PARTICIPANT"})
+	case errors.Is(err, service.ErrInvalidImage):
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid image", "error": "INVALID_IMAGE"})
+	case errors.Is(err, service.ErrImageTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Image too large to process", "error": "IMAGE_TOO_LARGE"})
+	case errors.Is(err, service.ErrQuotaExceeded):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Storage quota exceeded", "error": "QUOTA_EXCEEDED"})
+	case errors.Is(err, service.ErrAttachmentTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Attachment too large", "error": "ATTACHMENT_TOO_LARGE"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Attachment operation failed", "error": err.Error()})
+	}
+}
+
+// UploadAttachment godoc
+// @Summary Upload a file attachment
+// @Description Stores the file and returns its id, which an "attachment" WebSocket message references in its body.
+// @Tags Attachment
+// @Accept multipart/form-data
+// @Produce json
+// @Param file formData file true "file to upload"
+// @Success 200 {object} map[string]interface{}
+// @Router /attachments [post]
+func UploadAttachment(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	// leave room for the multipart framing around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, service.AttachmentMaxSize+1<<20)
+	file, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			attachmentError(c, service.ErrAttachmentTooLarge)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"message": "file required", "error": err.Error()})
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to read upload", "error": err.Error()})
+		return
+	}
+	defer f.Close()
+	a, err := service.CreateAttachment(uid, file.Filename, f, file.Size)
+	if err != nil {
+		attachmentError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": a})
+}
+
+// DownloadAttachment godoc
+// @Summary Download an attachment
+// @Description Only the uploader and the participants of the conversation it was sent in may download it.
+// @Tags Attachment
+// @Param id path int true "Attachment id"
+// @Success 200 {file} file
+// @Router /attachments/{id} [get]
+func DownloadAttachment(c *gin.Context) {
+	serveAttachment(c, false)
+}
+
+// DownloadThumbnail godoc
+// @Summary Download the thumbnail of an image attachment
+// @Description Same access rules as the attachment itself. Thumbnails are JPEGs at most 320 pixels on their longest side.
+// @Tags Attachment
+// @Param id path int true "Attachment id"
+// @Success 200 {file} file
+// @Router /attachments/{id}/thumbnail [get]
+func DownloadThumbnail(c *gin.Context) {
+	serveAttachment(c, true)
+}
+
+func serveAttachment(c *gin.Context, thumbnail bool) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	id, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	a, err := service.GetAttachment(uid, id)
+	if err != nil {
+		attachmentError(c, err)
+		return
+	}
+	r, err := service.OpenAttachment(a, thumbnail)
+	if err != nil {
+		attachmentError(c, err)
+		return
+	}
+	defer r.Close()
+	if thumbnail {
+		c.Header("Content-Type", "image/jpeg")
+	} else {
+		c.Header("Content-Type", a.ContentType)
+		c.Header("Content-Length", strconv.FormatInt(a.Size, 10))
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Status(http.StatusOK)
+	io.Copy(c.Writer, r)
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+
+	"chat/middleware"
+	"chat/model"
+	"chat/service"
+	"chat/ws"
+)
+
+// issueTokens starts a session for user and returns its access and refresh
+// tokens.
+func issueTokens(c *gin.Context, user *model.UserBasic) (token, refresh string, err error) {
+	sid, refresh, err := service.CreateSession(user.ID, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		return "", "", err
+	}
+	token, err = middleware.GenerateTokenForUser(user, sid)
+	if err != nil {
+		return "", "", err
+	}
+	return token, refresh, nil
+}
+
+// RefreshToken godoc
+// @Summary Exchange a refresh token for new tokens
+// @Description Returns a new access token and a new refresh token; the old refresh token stops working. Presenting a refresh token twice ends its session and closes its WebSocket connections.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param request body map[string]string true "Refresh request {refresh_token}"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /auth/refresh [post]
+func RefreshToken(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request", "error": err.Error()})
+		return
+	}
+	user, session, refresh, err := service.RefreshSession(req.RefreshToken, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrRefreshTokenInvalid):
+			c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid refresh token", "error": "INVALID_REFRESH_TOKEN"})
+		case errors.Is(err, service.ErrRefreshTokenReused):
+			// connections opened with the stolen session's tokens close too
+			ws.DefaultHub.LogoutSession(session.UserID, session.FamilyID)
+			c.JSON(http.StatusUnauthorized, gin.H{"message": "Refresh token reused; the session was ended", "error": "REFRESH_TOKEN_REUSED"})
+		case errors.Is(err, service.ErrSuspended):
+			c.JSON(http.StatusForbidden, gin.H{"message": "Account suspended", "error": "ACCOUNT_SUSPENDED"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to refresh token", "error": err.Error()})
+		}
+		return
+	}
+	token, err := middleware.GenerateTokenForUser(user, session.FamilyID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to generate token", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "user_id": user.ID, "token": token, "refresh_token": refresh})
+}
+
+// Logout godoc
+// @Summary End the current session
+// @Description Closes the WebSocket connections made with the session's tokens. With all set, ends every session of the user and closes all of their connections.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param request body map[string]interface{} false "Logout request {all}"
+// @Success 200 {object} map[string]interface{}
+// @Router /auth/logout [post]
+func Logout(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		All bool `json:"all"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request", "error": err.Error()})
+			return
+		}
+	}
+	if req.All {
+		if err := service.RevokeTokens(uid); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to log out", "error": err.Error()})
+			return
+		}
+		ws.DefaultHub.Logout(uid)
+		c.JSON(http.StatusOK, gin.H{"message": "ok"})
+		return
+	}
+	sid, _ := jwt.ExtractClaims(c)["sid"].(string)
+	if sid != "" {
+		if err := service.RevokeSession(uid, sid); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to log out", "error": err.Error()})
+			return
+		}
+		ws.DefaultHub.LogoutSession(uid, sid)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
@@ -1,64 +1,187 @@
 package api
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
-	"path/filepath"
+	"path"
+	"slices"
+	"strconv"
 	"time"
 
-	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
 
-	"chat/global"
+	"chat/imaging"
+	"chat/service"
 )
 
 // UploadAvatar handles multipart avatar upload for current user.
 // @Summary Upload avatar for current user
+// @Description The file must be a JPEG, PNG or GIF of at most 10 MiB; it is detected from its content, not its name. Square 64, 128 and 512 pixel versions are generated without EXIF metadata and the 128 pixel one becomes avatar_url.
 // @Accept multipart/form-data
 // @Param avatar formData file true "avatar file"
 // @Success 200 {object} map[string]interface{}
 // @Router /user/avatar [post]
 func UploadAvatar(c *gin.Context) {
-	claims := jwt.ExtractClaims(c)
-	var uid uint
-	if idf, ok := claims["id"].(float64); ok {
-		uid = uint(idf)
-	} else {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": "unauthorized"})
+	uid, ok := currentUserID(c)
+	if !ok {
 		return
 	}
 
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, service.AvatarMaxSize+1<<20)
 	file, err := c.FormFile("avatar")
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "avatar must be at most 10 MiB", "error": "AVATAR_TOO_LARGE"})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"message": "avatar file required", "error": err.Error()})
 		return
 	}
+	if file.Size > service.AvatarMaxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "avatar must be at most 10 MiB", "error": "AVATAR_TOO_LARGE"})
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to read avatar", "error": err.Error()})
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to read avatar", "error": err.Error()})
+		return
+	}
 
-	// ensure upload dir exists
-	uploadDir := filepath.Join("web", "avatars")
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to create upload dir", "error": err.Error()})
+	urls, err := service.SaveAvatar(uid, data)
+	switch {
+	case errors.Is(err, imaging.ErrUnsupported):
+		c.JSON(http.StatusBadRequest, gin.H{"message": "avatar must be a JPEG, PNG or GIF image", "error": "INVALID_IMAGE"})
+		return
+	case errors.Is(err, imaging.ErrTooLarge):
+		c.JSON(http.StatusBadRequest, gin.H{"message": "avatar dimensions too large", "error": "IMAGE_TOO_LARGE"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to save avatar", "error": err.Error()})
 		return
 	}
 
-	ext := filepath.Ext(file.Filename)
-	fname := fmt.Sprintf("%d_%d%s", uid, time.Now().Unix(), ext)
-	dst := filepath.Join(uploadDir, fname)
+	// the uploader may have hidden the avatar from everyone but themselves
+	for size, url := range urls {
+		if urls[size], err = service.ViewerAvatarURL(url, uid, uid); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load privacy settings", "error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "avatar_url": urls[service.DefaultAvatarSize], "avatars": urls})
+}
 
-	if err := c.SaveUploadedFile(file, dst); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to save avatar", "error": err.Error()})
+// Clients may reuse an avatar for five minutes before revalidating it with
+// its ETag, which bounds how long a changed avatar can look stale. Answers
+// to an identified viewer may depend on privacy settings and are not shared.
+const (
+	avatarMaxAge        = "public, max-age=300"
+	avatarMaxAgePrivate = "private, max-age=300"
+)
+
+// GetAvatar godoc
+// @Summary Get a user's avatar
+// @Description Serves the uploaded avatar, or a generated identicon derived from the user's id and name when there is none or the user's privacy settings hide it from the caller. A JWT, or the signed viewer token that avatar URLs of restricted avatars carry, is optional and only identifies the caller. format (png or svg) only applies to identicons. Responses carry an ETag and honour If-None-Match.
+// @Tags User
+// @Produce png
+// @Param id path int true "User id"
+// @Param size query int false "64, 128 (default) or 512"
+// @Param format query string false "png (default) or svg"
+// @Param viewer query int false "Viewer the signed avatar URL was made for"
+// @Param exp query int false "Expiry of the viewer token, Unix seconds"
+// @Param sig query string false "Signature of the viewer token"
+// @Success 200 {file} binary
+// @Router /avatar/{id} [get]
+func GetAvatar(c *gin.Context) {
+	id, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	size := service.DefaultAvatarSize
+	if s := c.Query("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || !slices.Contains(service.AvatarSizes, n) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "size must be 64, 128 or 512", "error": "INVALID_SIZE"})
+			return
+		}
+		size = n
+	}
+	format := c.DefaultQuery("format", "png")
+	if format != "png" && format != "svg" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "format must be png or svg", "error": "INVALID_FORMAT"})
 		return
 	}
 
-	// store public path (served under /static)
-	avatarURL := "/static/avatars/" + fname
+	// the route is public; a token, when sent, identifies the viewer for
+	// privacy settings. Images cannot send headers, so avatar URLs handed
+	// to viewers of restricted avatars carry a signed viewer token instead.
+	var viewer uint
+	if token := c.GetHeader("Authorization"); token != "" {
+		if user, _, err := service.AuthenticateToken(token); err == nil {
+			viewer = user.ID
+		}
+	} else if c.Query("sig") != "" {
+		viewer = service.AvatarViewer(id, c.Query("viewer"), c.Query("exp"), c.Query("sig"))
+	}
+	a, err := service.FindAvatar(id, viewer, size)
+	if err != nil {
+		if err.Error() == "user not found" {
+			c.JSON(http.StatusNotFound, gin.H{"message": "User not found", "error": "USER_NOT_FOUND"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load avatar", "error": err.Error()})
+		return
+	}
+	if viewer != 0 {
+		// the answer depends on who asked
+		c.Header("Cache-Control", avatarMaxAgePrivate)
+	} else {
+		c.Header("Cache-Control", avatarMaxAge)
+	}
 
-	// update user record
-	if err := global.GVA_DB.Model("user_basic").Where("id = ?", uid).Update("avatar_url", avatarURL).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to update user avatar", "error": err.Error()})
+	if a.URL != "" {
+		c.Redirect(http.StatusFound, a.URL)
 		return
 	}
+	if len(a.Keys) > 0 {
+		if r, key, err := service.OpenAvatar(a); err == nil {
+			defer r.Close()
+			if data, err := io.ReadAll(r); err == nil {
+				// keys are never reused for other contents
+				c.Header("ETag", etag(key))
+				// ServeContent answers If-None-Match and sniffs the
+				// content type of keys without an extension
+				http.ServeContent(c.Writer, c.Request, path.Base(key), time.Time{}, bytes.NewReader(data))
+				return
+			}
+		}
+		// the file went missing: fall back to the identicon
+	}
+
+	var out []byte
+	if format == "svg" {
+		out = imaging.IdenticonSVG(a.Seed, size)
+	} else if out, err = imaging.EncodePNG(imaging.Identicon(a.Seed, size)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to draw avatar", "error": err.Error()})
+		return
+	}
+	c.Header("ETag", etag(a.Seed, size, format))
+	http.ServeContent(c.Writer, c.Request, "avatar."+format, time.Time{}, bytes.NewReader(out))
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "ok", "avatar_url": avatarURL})
+// etag hashes parts into a strong entity tag.
+func etag(parts ...any) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%#v", parts)))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
 }
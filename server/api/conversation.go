@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"chat/service"
+)
+
+// ListConversations godoc
+// @Summary List the current user's conversations
+// @Description Direct peers and rooms the user has exchanged messages in, most recently active first, with the latest message preview and unread count.
+// @Tags Conversation
+// @Produce json
+// @Param before query int false "Continue after the conversation whose last_message_id is this value"
+// @Param limit query int false "Page size (default 50, max 200)"
+// @Success 200 {object} map[string]interface{}
+// @Router /conversations [get]
+func ListConversations(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	before, limit, ok := pageQuery(c)
+	if !ok {
+		return
+	}
+	convs, next, err := service.ListConversations(uid, before, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load conversations", "error": err.Error()})
+		return
+	}
+	var cursor interface{}
+	if next > 0 {
+		cursor = next
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": convs, "has_more": next > 0, "next_cursor": cursor})
+}
+
+// MarkConversationRead godoc
+// @Summary Reset the unread count of a conversation
+// @Tags Conversation
+// @Accept json
+// @Produce json
+// @Param request body map[string]interface{} true "Either {with: <user id>} or {room_id: \"7\"}"
+// @Success 200 {object} map[string]interface{}
+// @Router /conversations/read [post]
+func MarkConversationRead(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		With   uint   `json:"with"`
+		RoomID string `json:"room_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request", "error": err.Error()})
+		return
+	}
+	if (req.With == 0) == (req.RoomID == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "exactly one of with and room_id is required"})
+		return
+	}
+	if err := service.MarkConversationRead(uid, req.With, req.RoomID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to update conversation", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"chat/model"
+	"chat/service"
+	"chat/ws"
+)
+
+// friendError maps contact and block service errors to HTTP responses.
+func friendError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrFriendSelf):
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Cannot befriend yourself", "error": "FRIEND_SELF"})
+	case errors.Is(err, service.ErrFriendRequestNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": "Friend request not found", "error": "FRIEND_REQUEST_NOT_FOUND"})
+	case errors.Is(err, service.ErrBlockSelf):
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Cannot block yourself", "error": "BLOCK_SELF"})
+	case errors.Is(err, service.ErrNotBlocked):
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not blocked", "error": "NOT_BLOCKED"})
+	case errors.Is(err, service.ErrBlocked):
+		c.JSON(http.StatusForbidden, gin.H{"message": "User unavailable", "error": "USER_UNAVAILABLE"})
+	case errors.Is(err, service.ErrNotFriends):
+		c.JSON(http.StatusNotFound, gin.H{"message": "Not a contact", "error": "NOT_FRIENDS"})
+	case err.Error() == "user not found":
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found", "error": "USER_NOT_FOUND"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Contact operation failed", "error": err.Error()})
+	}
+}
+
+// ListFriends godoc
+// @Summary List the current user's contacts and friend requests
+// @Tags Friend
+// @Produce json
+// @Param status query string false "accepted, incoming or outgoing; all when empty"
+// @Success 200 {object} map[string]interface{}
+// @Router /friends [get]
+func ListFriends(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	status := c.Query("status")
+	if status != "" && status != "accepted" && status != "incoming" && status != "outgoing" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "status must be accepted, incoming or outgoing", "error": "INVALID_STATUS"})
+		return
+	}
+	contacts, err := service.ListContacts(uid, status)
+	if err != nil {
+		friendError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": contacts})
+}
+
+// RequestFriend godoc
+// @Summary Send a friend request
+// @Description Asking a user who already asked you accepts their request.
+// @Tags Friend
+// @Accept json
+// @Produce json
+// @Param request body map[string]interface{} true "Friend request {user_id}"
+// @Success 200 {object} map[string]interface{}
+// @Router /friends/requests [post]
+func RequestFriend(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		UserID uint `json:"user_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request", "error": err.Error()})
+		return
+	}
+	f, changed, err := service.RequestFriend(uid, req.UserID)
+	if err != nil {
+		friendError(c, err)
+		return
+	}
+	if changed {
+		if f.Status == model.FriendshipAccepted {
+			ws.DefaultHub.Dispatch(&ws.Message{Type: "friend_accept", From: uid, To: req.UserID})
+		} else {
+			ws.DefaultHub.Dispatch(&ws.Message{Type: "friend_request", From: uid, To: req.UserID})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": f})
+}
+
+// AcceptFriend godoc
+// @Summary Accept a friend request
+// @Tags Friend
+// @Produce json
+// @Param user_id path int true "Requester id"
+// @Success 200 {object} map[string]interface{}
+// @Router /friends/requests/{user_id}/accept [post]
+func AcceptFriend(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	requester, ok := pathID(c, "user_id")
+	if !ok {
+		return
+	}
+	f, err := service.AcceptFriend(uid, requester)
+	if err != nil {
+		friendError(c, err)
+		return
+	}
+	ws.DefaultHub.Dispatch(&ws.Message{Type: "friend_accept", From: uid, To: requester})
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": f})
+}
+
+// DeclineFriend godoc
+// @Summary Decline a friend request
+// @Description The requester is not notified.
+// @Tags Friend
+// @Produce json
+// @Param user_id path int true "Requester id"
+// @Success 200 {object} map[string]interface{}
+// @Router /friends/requests/{user_id}/decline [post]
+func DeclineFriend(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	requester, ok := pathID(c, "user_id")
+	if !ok {
+		return
+	}
+	if err := service.DeclineFriend(uid, requester); err != nil {
+		friendError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+// RemoveFriend godoc
+// @Summary Remove a contact or withdraw a friend request
+// @Tags Friend
+// @Produce json
+// @Param user_id path int true "Contact id"
+// @Success 200 {object} map[string]interface{}
+// @Router /friends/{user_id} [delete]
+func RemoveFriend(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	other, ok := pathID(c, "user_id")
+	if !ok {
+		return
+	}
+	if err := service.RemoveFriend(uid, other); err != nil {
+		friendError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+// ListBlocks godoc
+// @Summary List the users the current user blocked
+// @Tags Friend
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /blocks [get]
+func ListBlocks(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	blocks, err := service.ListBlocks(uid)
+	if err != nil {
+		friendError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": blocks})
+}
+
+// BlockUser godoc
+// @Summary Block a user
+// @Description Ends any friendship or request with the user. Neither side can then message, befriend, watch the presence of or see typing from the other.
+// @Tags Friend
+// @Accept json
+// @Produce json
+// @Param request body map[string]interface{} true "Block request {user_id}"
+// @Success 200 {object} map[string]interface{}
+// @Router /blocks [post]
+func BlockUser(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		UserID uint `json:"user_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request", "error": err.Error()})
+		return
+	}
+	created, err := service.BlockUser(uid, req.UserID)
+	if err != nil {
+		friendError(c, err)
+		return
+	}
+	if created {
+		ws.DefaultHub.DropWatches(uid, req.UserID)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+// UnblockUser godoc
+// @Summary Unblock a user
+// @Description Friendships ended by the block are not restored.
+// @Tags Friend
+// @Produce json
+// @Param user_id path int true "Blocked user id"
+// @Success 200 {object} map[string]interface{}
+// @Router /blocks/{user_id} [delete]
+func UnblockUser(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	other, ok := pathID(c, "user_id")
+	if !ok {
+		return
+	}
+	if err := service.UnblockUser(uid, other); err != nil {
+		friendError(c, err)
+		return
+	}
+	ws.DefaultHub.Unblocked(uid, other)
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+    "errors"
     "net/http"
     "strconv"
 
@@ -8,12 +9,17 @@ import (
     "github.com/gin-gonic/gin"
 
     "chat/service"
+    "chat/ws"
 )
 
 // GetMessages godoc
 // @Summary Get chat messages between two users
+// @Description Returns messages in ascending id order. Without a cursor the newest page is returned.
 // @Param with query int true "Other user id"
-// @Param limit query int false "Limit"
+// @Param before_id query int false "Return messages older than this message id"
+// @Param after_id query int false "Return messages newer than this message id"
+// @Param around_id query int false "Return this message and the messages around it"
+// @Param limit query int false "Page size (default 100, max 200)"
 // @Success 200 {object} map[string]interface{}
 // @Router /messages [get]
 func GetMessages(c *gin.Context) {
@@ -36,16 +42,288 @@ func GetMessages(c *gin.Context) {
         c.JSON(http.StatusBadRequest, gin.H{"message": "invalid with"})
         return
     }
-    limit := 100
-    if lstr := c.Query("limit"); lstr != "" {
-        if lv, err := strconv.Atoi(lstr); err == nil && lv > 0 {
-            limit = lv
-        }
+    cur, ok := parseCursor(c)
+    if !ok {
+        return
+    }
+    if cur.Limit == 0 {
+        cur.Limit = 100
     }
-    msgs, err := service.GetMessagesBetween(uint(uid), uint(wid), limit)
+    page, err := service.GetMessagesBetween(uint(uid), uint(wid), cur)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load messages", "error": err.Error()})
         return
     }
-    c.JSON(http.StatusOK, gin.H{"message": "ok", "data": msgs})
+    pageResponse(c, cur, page)
+}
+
+// parseCursor reads the before/after/around and limit query parameters of a
+// history request, writing a 400 response when they are invalid. Cursors are
+// accepted both as `before` and `before_id`.
+func parseCursor(c *gin.Context) (service.MessageCursor, bool) {
+    var cur service.MessageCursor
+    set := 0
+    for _, p := range []struct {
+        name string
+        dst  *uint
+    }{{"before", &cur.Before}, {"after", &cur.After}, {"around", &cur.Around}} {
+        v := c.Query(p.name + "_id")
+        if v == "" {
+            v = c.Query(p.name)
+        }
+        if v == "" {
+            continue
+        }
+        id, err := strconv.ParseUint(v, 10, 64)
+        if err != nil || id == 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"message": "invalid " + p.name + "_id"})
+            return cur, false
+        }
+        *p.dst = uint(id)
+        set++
+    }
+    if set > 1 {
+        c.JSON(http.StatusBadRequest, gin.H{"message": "before_id, after_id and around_id are mutually exclusive"})
+        return cur, false
+    }
+    if v := c.Query("limit"); v != "" {
+        lv, err := strconv.Atoi(v)
+        if err != nil || lv <= 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"message": "invalid limit"})
+            return cur, false
+        }
+        cur.Limit = lv
+    }
+    return cur, true
+}
+
+// pageResponse renders a history page. next_cursor is the id to pass as
+// before_id (or after_id, when paging forward) to continue in the same
+// direction. Pages around a message report each side separately.
+func pageResponse(c *gin.Context, cur service.MessageCursor, page *service.MessagePage) {
+    c.JSON(http.StatusOK, pageBody(cur, page))
+}
+
+// pageBody builds the body written by pageResponse.
+func pageBody(cur service.MessageCursor, page *service.MessagePage) gin.H {
+    resp := gin.H{"message": "ok", "data": page.Messages, "has_more": page.HasMore}
+    msgs := page.Messages
+    var next interface{}
+    if cur.Around != 0 {
+        resp["has_older"] = page.HasOlder
+        resp["has_newer"] = page.HasNewer
+    } else if page.HasMore && len(msgs) > 0 {
+        if cur.After != 0 {
+            next = msgs[len(msgs)-1].ID
+        } else {
+            next = msgs[0].ID
+        }
+    }
+    resp["next_cursor"] = next
+    return resp
+}
+
+// GetMessageReads godoc
+// @Summary List who has read a message
+// @Description Returns the read markers of the participants, other than the sender, whose read watermark has reached the message.
+// @Tags Message
+// @Produce json
+// @Param id path int true "Message id"
+// @Success 200 {object} map[string]interface{}
+// @Router /messages/{id}/reads [get]
+func GetMessageReads(c *gin.Context) {
+    uid, ok := currentUserID(c)
+    if !ok {
+        return
+    }
+    id, ok := pathID(c, "id")
+    if !ok {
+        return
+    }
+    reads, err := service.GetMessageReads(uid, id)
+    if err != nil {
+        messageError(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"message": "ok", "data": reads})
+}
+
+// messageError maps message service errors to HTTP responses.
+func messageError(c *gin.Context, err error) {
+    switch {
+    case errors.Is(err, service.ErrMessageNotFound):
+        c.JSON(http.StatusNotFound, gin.H{"message": "Message not found", "error": "MESSAGE_NOT_FOUND"})
+    case errors.Is(err, service.ErrNotParticipant), errors.Is(err, service.ErrNotRoomMember):
+        c.JSON(http.StatusForbidden, gin.H{"message": "Not a participant", "error": "NOT_PARTICIPANT"})
+    case errors.Is(err, service.ErrNotMessageSender):
+        c.JSON(http.StatusForbidden, gin.H{"message": "Only the sender may change a message", "error": "NOT_MESSAGE_SENDER"})
+    case errors.Is(err, service.ErrInvalidEmoji):
+        c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid emoji", "error": "INVALID_EMOJI"})
+    case errors.Is(err, service.ErrMessageDeleted):
+        c.JSON(http.StatusGone, gin.H{"message": "Message deleted", "error": "MESSAGE_DELETED"})
+    case errors.Is(err, service.ErrNotEditable):
+        c.JSON(http.StatusBadRequest, gin.H{"message": "Attachment messages cannot be edited", "error": "MESSAGE_NOT_EDITABLE"})
+    default:
+        c.JSON(http.StatusInternalServerError, gin.H{"message": "Message operation failed", "error": err.Error()})
+    }
+}
+
+// EditMessage godoc
+// @Summary Edit a message sent by the current user
+// @Description Replaces the body, keeping the previous one as a revision, and pushes an edit frame to every participant.
+// @Tags Message
+// @Accept json
+// @Produce json
+// @Param id path int true "Message id"
+// @Param request body map[string]interface{} true "Edit request {body}"
+// @Success 200 {object} map[string]interface{}
+// @Router /messages/{id} [put]
+func EditMessage(c *gin.Context) {
+    uid, ok := currentUserID(c)
+    if !ok {
+        return
+    }
+    id, ok := pathID(c, "id")
+    if !ok {
+        return
+    }
+    var req struct {
+        Body string `json:"body" binding:"required"`
+    }
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request", "error": err.Error()})
+        return
+    }
+    m, err := service.EditMessage(uid, id, req.Body)
+    if err != nil {
+        messageError(c, err)
+        return
+    }
+    ws.DefaultHub.DispatchChange("edit", m)
+    c.JSON(http.StatusOK, gin.H{"message": "ok", "data": m})
+}
+
+// DeleteMessage godoc
+// @Summary Delete a message sent by the current user
+// @Description Leaves a tombstone with an empty body and pushes a delete frame to every participant.
+// @Tags Message
+// @Produce json
+// @Param id path int true "Message id"
+// @Success 200 {object} map[string]interface{}
+// @Router /messages/{id} [delete]
+func DeleteMessage(c *gin.Context) {
+    uid, ok := currentUserID(c)
+    if !ok {
+        return
+    }
+    id, ok := pathID(c, "id")
+    if !ok {
+        return
+    }
+    m, err := service.DeleteMessage(uid, id)
+    if err != nil {
+        messageError(c, err)
+        return
+    }
+    ws.DefaultHub.DispatchChange("delete", m)
+    c.JSON(http.StatusOK, gin.H{"message": "ok", "data": m})
+}
+
+// AddReaction godoc
+// @Summary React to a message
+// @Tags Message
+// @Accept json
+// @Produce json
+// @Param id path int true "Message id"
+// @Param request body map[string]interface{} true "Reaction request {emoji}"
+// @Success 200 {object} map[string]interface{}
+// @Router /messages/{id}/reactions [post]
+func AddReaction(c *gin.Context) {
+    uid, ok := currentUserID(c)
+    if !ok {
+        return
+    }
+    id, ok := pathID(c, "id")
+    if !ok {
+        return
+    }
+    var req struct {
+        Emoji string `json:"emoji" binding:"required"`
+    }
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request", "error": err.Error()})
+        return
+    }
+    m, added, err := service.AddReaction(uid, id, req.Emoji)
+    if err != nil {
+        messageError(c, err)
+        return
+    }
+    if added {
+        ws.DefaultHub.DispatchReaction(m, uid, req.Emoji, "add")
+    }
+    c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+// RemoveReaction godoc
+// @Summary Remove the current user's reaction from a message
+// @Tags Message
+// @Produce json
+// @Param id path int true "Message id"
+// @Param emoji path string true "URL-encoded emoji"
+// @Success 200 {object} map[string]interface{}
+// @Router /messages/{id}/reactions/{emoji} [delete]
+func RemoveReaction(c *gin.Context) {
+    uid, ok := currentUserID(c)
+    if !ok {
+        return
+    }
+    id, ok := pathID(c, "id")
+    if !ok {
+        return
+    }
+    emoji := c.Param("emoji")
+    m, removed, err := service.RemoveReaction(uid, id, emoji)
+    if err != nil {
+        messageError(c, err)
+        return
+    }
+    if removed {
+        ws.DefaultHub.DispatchReaction(m, uid, emoji, "remove")
+    }
+    c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+// GetThread godoc
+// @Summary Get a message thread
+// @Description Returns the root of the thread the message belongs to and a page of its replies in ascending id order. Cursors work as for GET /messages.
+// @Tags Message
+// @Produce json
+// @Param id path int true "Id of the root or of any reply"
+// @Param before_id query int false "Return replies older than this message id"
+// @Param after_id query int false "Return replies newer than this message id"
+// @Param limit query int false "Page size (default 50, max 200)"
+// @Success 200 {object} map[string]interface{}
+// @Router /messages/{id}/thread [get]
+func GetThread(c *gin.Context) {
+    uid, ok := currentUserID(c)
+    if !ok {
+        return
+    }
+    id, ok := pathID(c, "id")
+    if !ok {
+        return
+    }
+    cur, ok := parseCursor(c)
+    if !ok {
+        return
+    }
+    root, page, err := service.GetThread(uid, id, cur)
+    if err != nil {
+        messageError(c, err)
+        return
+    }
+    resp := pageBody(cur, page)
+    resp["root"] = root
+    c.JSON(http.StatusOK, resp)
 }
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"chat/service"
+)
+
+// GetPresence godoc
+// @Summary Get a user's presence
+// @Description Returns online, away or offline, with last_seen when the user is not online and their privacy settings allow the caller to see it. Users blocked either way always look offline.
+// @Tags User
+// @Produce json
+// @Param id path int true "User id"
+// @Success 200 {object} map[string]interface{}
+// @Router /users/{id}/presence [get]
+func GetPresence(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	id, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	p, err := service.GetPresence(uid, id)
+	if err != nil {
+		if err.Error() == "user not found" {
+			c.JSON(http.StatusNotFound, gin.H{"message": "User not found", "error": "USER_NOT_FOUND"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load presence", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": p})
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"chat/service"
+)
+
+// GetPrivacy godoc
+// @Summary Get the current user's privacy settings
+// @Tags User
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /user/privacy [get]
+func GetPrivacy(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	s, err := service.GetPrivacy(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load privacy settings", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": s})
+}
+
+// UpdatePrivacy godoc
+// @Summary Change who may see the current user's last-seen time and avatar
+// @Description Each of last_seen, avatar and contact_lookup is everyone, contacts or nobody; omitted fields keep their value.
+// @Tags User
+// @Accept json
+// @Produce json
+// @Param request body map[string]interface{} true "Privacy settings {last_seen, avatar, contact_lookup}"
+// @Success 200 {object} map[string]interface{}
+// @Router /user/privacy [put]
+func UpdatePrivacy(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		LastSeen      *string `json:"last_seen"`
+		Avatar        *string `json:"avatar"`
+		ContactLookup *string `json:"contact_lookup"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request", "error": err.Error()})
+		return
+	}
+	s, err := service.UpdatePrivacy(uid, req.LastSeen, req.Avatar, req.ContactLookup)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidAudience) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "settings must be everyone, contacts or nobody", "error": "INVALID_AUDIENCE"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to save privacy settings", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": s})
+}
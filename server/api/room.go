@@ -0,0 +1,217 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"chat/service"
+	"chat/ws"
+)
+
+// roomError maps room service errors to HTTP responses.
+func roomError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrRoomNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": "Room not found", "error": "ROOM_NOT_FOUND"})
+	case errors.Is(err, service.ErrNotRoomMember):
+		c.JSON(http.StatusForbidden, gin.H{"message": "Not a room member", "error": "NOT_ROOM_MEMBER"})
+	case errors.Is(err, service.ErrRoomForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"message": "Insufficient room role", "error": "ROOM_FORBIDDEN"})
+	case errors.Is(err, service.ErrInvalidRole):
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Role must be member or admin", "error": "INVALID_ROLE"})
+	case err.Error() == "user not found":
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found", "error": "USER_NOT_FOUND"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Room operation failed", "error": err.Error()})
+	}
+}
+
+// CreateRoom godoc
+// @Summary Create a room owned by the current user
+// @Tags Room
+// @Accept json
+// @Produce json
+// @Param request body map[string]interface{} true "Create room request {name, members}"
+// @Success 200 {object} map[string]interface{}
+// @Router /rooms [post]
+func CreateRoom(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name    string `json:"name" binding:"required"`
+		Members []uint `json:"members"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request", "error": err.Error()})
+		return
+	}
+	room, members, err := service.CreateRoom(uid, req.Name, req.Members)
+	if err != nil {
+		roomError(c, err)
+		return
+	}
+	roomID := strconv.FormatUint(uint64(room.ID), 10)
+	ws.DefaultHub.Dispatch(&ws.Message{Type: "room_joined", To: uid, RoomID: roomID})
+	for _, member := range members {
+		ws.DefaultHub.Dispatch(&ws.Message{Type: "room_joined", From: uid, To: member, RoomID: roomID})
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": room})
+}
+
+// ListRooms godoc
+// @Summary List rooms the current user belongs to
+// @Tags Room
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /rooms [get]
+func ListRooms(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	rooms, err := service.ListUserRooms(uid)
+	if err != nil {
+		roomError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": rooms})
+}
+
+// AddRoomMember godoc
+// @Summary Invite a user to a room
+// @Description Owners and admins may invite members; only the owner may add admins.
+// @Tags Room
+// @Accept json
+// @Produce json
+// @Param id path int true "Room ID"
+// @Param request body map[string]interface{} true "Invite request {user_id, role}"
+// @Success 200 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Router /rooms/{id}/members [post]
+func AddRoomMember(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	roomID, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		UserID uint   `json:"user_id" binding:"required"`
+		Role   string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request", "error": err.Error()})
+		return
+	}
+	member, err := service.AddRoomMember(uid, roomID, req.UserID, req.Role)
+	if err != nil {
+		roomError(c, err)
+		return
+	}
+	ws.DefaultHub.Dispatch(&ws.Message{Type: "room_joined", From: uid, To: req.UserID, RoomID: strconv.FormatUint(uint64(roomID), 10)})
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": member})
+}
+
+// RemoveRoomMember godoc
+// @Summary Remove a member from a room, or leave it
+// @Description Members may remove themselves; owners remove anyone but themselves and admins remove members.
+// @Tags Room
+// @Produce json
+// @Param id path int true "Room ID"
+// @Param user_id path int true "User ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Router /rooms/{id}/members/{user_id} [delete]
+func RemoveRoomMember(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	roomID, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	target, ok := pathID(c, "user_id")
+	if !ok {
+		return
+	}
+	if err := service.RemoveRoomMember(uid, roomID, target); err != nil {
+		roomError(c, err)
+		return
+	}
+	ws.DefaultHub.Dispatch(&ws.Message{Type: "room_left", From: uid, To: target, RoomID: strconv.FormatUint(uint64(roomID), 10)})
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+// ListRoomMembers godoc
+// @Summary List the members of a room
+// @Tags Room
+// @Produce json
+// @Param id path int true "Room ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Router /rooms/{id}/members [get]
+func ListRoomMembers(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	roomID, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	if _, err := service.GetRoomMember(roomID, uid); err != nil {
+		roomError(c, err)
+		return
+	}
+	members, err := service.ListRoomMembers(roomID)
+	if err != nil {
+		roomError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": members})
+}
+
+// GetRoomMessages godoc
+// @Summary Page through the message history of a room
+// @Description Returns messages in ascending id order. Without a cursor the newest page is returned.
+// @Tags Room
+// @Produce json
+// @Param id path int true "Room ID"
+// @Param before query int false "Return messages older than this message id"
+// @Param after query int false "Return messages newer than this message id"
+// @Param limit query int false "Page size (default 50, max 200)"
+// @Success 200 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Router /rooms/{id}/messages [get]
+func GetRoomMessages(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	roomID, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	cur, ok := parseCursor(c)
+	if !ok {
+		return
+	}
+	if _, err := service.GetRoomMember(roomID, uid); err != nil {
+		roomError(c, err)
+		return
+	}
+	page, err := service.GetRoomMessages(roomID, cur)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load messages", "error": err.Error()})
+		return
+	}
+	pageResponse(c, cur, page)
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"chat/service"
+)
+
+// Resumable uploads follow the tus 1.0.0 protocol (https://tus.io) with the
+// creation and termination extensions.
+const tusVersion = "1.0.0"
+
+// tusHeaders sets the headers every tus response carries.
+func tusHeaders(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Cache-Control", "no-store")
+}
+
+// tusCheck rejects requests from clients speaking another tus version.
+func tusCheck(c *gin.Context) bool {
+	tusHeaders(c)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// uploadError maps upload service errors to tus status codes.
+func uploadError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrUploadNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": "Upload not found", "error": "UPLOAD_NOT_FOUND"})
+	case errors.Is(err, service.ErrUploadOffset):
+		c.JSON(http.StatusConflict, gin.H{"message": "Upload-Offset does not match", "error": "UPLOAD_OFFSET_MISMATCH"})
+	case errors.Is(err, service.ErrUploadBusy):
+		c.JSON(http.StatusLocked, gin.H{"message": "Upload is being written", "error": "UPLOAD_BUSY"})
+	case errors.Is(err, service.ErrUploadComplete):
+		c.JSON(http.StatusForbidden, gin.H{"message": "Upload already complete", "error": "UPLOAD_COMPLETE"})
+	case errors.Is(err, service.ErrUploadTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Upload too large", "error": "UPLOAD_TOO_LARGE"})
+	case errors.Is(err, service.ErrInvalidImage):
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid image", "error": "INVALID_IMAGE"})
+	case errors.Is(err, service.ErrImageTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Image too large to process", "error": "IMAGE_TOO_LARGE"})
+	case errors.Is(err, service.ErrQuotaExceeded):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Storage quota exceeded", "error": "QUOTA_EXCEEDED"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Upload failed", "error": err.Error()})
+	}
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma-separated
+// "key base64value" pairs.
+func parseUploadMetadata(h string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(h, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		if b, err := base64.StdEncoding.DecodeString(val); err == nil {
+			meta[key] = string(b)
+		}
+	}
+	return meta
+}
+
+// UploadOptions godoc
+// @Summary Describe the resumable upload endpoint
+// @Tags Upload
+// @Success 204
+// @Router /uploads [options]
+func UploadOptions(c *gin.Context) {
+	tusHeaders(c)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", "creation,termination")
+	c.Header("Tus-Max-Size", strconv.FormatInt(service.UploadMaxSize, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// CreateUpload godoc
+// @Summary Start a resumable upload
+// @Description tus creation: Upload-Length gives the total size and Upload-Metadata may carry a base64 filename.
+// @Tags Upload
+// @Param Upload-Length header int true "Total size in bytes"
+// @Param Upload-Metadata header string false "tus metadata, e.g. filename <base64>"
+// @Success 201
+// @Router /uploads [post]
+func CreateUpload(c *gin.Context) {
+	if !tusCheck(c) {
+		return
+	}
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid Upload-Length"})
+		return
+	}
+	meta := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	u, err := service.CreateUpload(uid, length, name)
+	if err != nil {
+		uploadError(c, err)
+		return
+	}
+	c.Header("Location", "/uploads/"+u.ID)
+	c.Header("Upload-Offset", "0")
+	c.Status(http.StatusCreated)
+}
+
+// UploadStatus godoc
+// @Summary Get the offset of a resumable upload
+// @Tags Upload
+// @Param id path string true "Upload id"
+// @Success 200
+// @Router /uploads/{id} [head]
+func UploadStatus(c *gin.Context) {
+	if !tusCheck(c) {
+		return
+	}
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	u, err := service.GetUpload(uid, c.Param("id"))
+	if err != nil {
+		if errors.Is(err, service.ErrUploadNotFound) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if u.AttachmentID != nil {
+		c.Header("Upload-Attachment-Id", strconv.FormatUint(uint64(*u.AttachmentID), 10))
+	}
+	c.Status(http.StatusOK)
+}
+
+// WriteUpload godoc
+// @Summary Append a chunk to a resumable upload
+// @Description The body must start at Upload-Offset. When the last byte arrives the file becomes an attachment, whose id is returned in Upload-Attachment-Id.
+// @Tags Upload
+// @Accept application/offset+octet-stream
+// @Param id path string true "Upload id"
+// @Param Upload-Offset header int true "Offset the body starts at"
+// @Success 204
+// @Router /uploads/{id} [patch]
+func WriteUpload(c *gin.Context) {
+	if !tusCheck(c) {
+		return
+	}
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"message": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid Upload-Offset"})
+		return
+	}
+	u, err := service.WriteUpload(uid, c.Param("id"), offset, c.Request.Body)
+	if u != nil {
+		c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	}
+	if err != nil {
+		uploadError(c, err)
+		return
+	}
+	if u.AttachmentID != nil {
+		c.Header("Upload-Attachment-Id", strconv.FormatUint(uint64(*u.AttachmentID), 10))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// DeleteUpload godoc
+// @Summary Abandon a resumable upload
+// @Tags Upload
+// @Param id path string true "Upload id"
+// @Success 204
+// @Router /uploads/{id} [delete]
+func DeleteUpload(c *gin.Context) {
+	if !tusCheck(c) {
+		return
+	}
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	if err := service.DeleteUpload(uid, c.Param("id")); err != nil {
+		uploadError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+
+	"chat/service"
+)
+
+// uploadRouter serves the tus routes as user 1, standing in for the JWT
+// middleware.
+func uploadRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.OPTIONS("/uploads", UploadOptions)
+	auth := r.Group("/", func(c *gin.Context) {
+		c.Set("JWT_PAYLOAD", jwt.MapClaims{"id": float64(1)})
+	})
+	auth.POST("/uploads", CreateUpload)
+	auth.HEAD("/uploads/:id", UploadStatus)
+	auth.PATCH("/uploads/:id", WriteUpload)
+	auth.DELETE("/uploads/:id", DeleteUpload)
+	return r
+}
+
+func tusRequest(r *gin.Engine, method, path string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestUploadOptionsAdvertisesTus(t *testing.T) {
+	w := tusRequest(uploadRouter(), http.MethodOptions, "/uploads", nil, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", w.Code)
+	}
+	for header, want := range map[string]string{
+		"Tus-Resumable": tusVersion,
+		"Tus-Version":   tusVersion,
+		"Tus-Extension": "creation,termination",
+		"Tus-Max-Size":  strconv.FormatInt(service.UploadMaxSize, 10),
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Fatalf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestUploadsRequireTusVersion(t *testing.T) {
+	r := uploadRouter()
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodPost, "/uploads"},
+		{http.MethodHead, "/uploads/abc"},
+		{http.MethodPatch, "/uploads/abc"},
+		{http.MethodDelete, "/uploads/abc"},
+	} {
+		w := tusRequest(r, tc.method, tc.path, map[string]string{"Tus-Resumable": "0.2.2"}, "")
+		if w.Code != http.StatusPreconditionFailed {
+			t.Fatalf("%s %s: status = %d, want 412", tc.method, tc.path, w.Code)
+		}
+		if got := w.Header().Get("Tus-Version"); got != tusVersion {
+			t.Fatalf("%s %s: Tus-Version = %q", tc.method, tc.path, got)
+		}
+	}
+}
+
+func TestCreateUploadChecksLength(t *testing.T) {
+	r := uploadRouter()
+	for length, want := range map[string]int{
+		"":   http.StatusBadRequest,
+		"-1": http.StatusBadRequest,
+		"0":  http.StatusBadRequest,
+		"x":  http.StatusBadRequest,
+		strconv.FormatInt(service.UploadMaxSize+1, 10): http.StatusRequestEntityTooLarge,
+	} {
+		w := tusRequest(r, http.MethodPost, "/uploads", map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": length}, "")
+		if w.Code != want {
+			t.Fatalf("Upload-Length %q: status = %d, want %d", length, w.Code, want)
+		}
+	}
+}
+
+func TestWriteUploadChecksRequest(t *testing.T) {
+	r := uploadRouter()
+	w := tusRequest(r, http.MethodPatch, "/uploads/abc", map[string]string{
+		"Tus-Resumable": tusVersion, "Content-Type": "application/octet-stream", "Upload-Offset": "0",
+	}, "data")
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("status = %d, want 415", w.Code)
+	}
+	for _, offset := range []string{"", "-1", "x"} {
+		w := tusRequest(r, http.MethodPatch, "/uploads/abc", map[string]string{
+			"Tus-Resumable": tusVersion, "Content-Type": "application/offset+octet-stream", "Upload-Offset": offset,
+		}, "data")
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Upload-Offset %q: status = %d, want 400", offset, w.Code)
+		}
+	}
+}
+
+func TestParseUploadMetadata(t *testing.T) {
+	meta := parseUploadMetadata("filename cmVwb3J0LnBkZg==, is_confidential, bad !!!")
+	if meta["filename"] != "report.pdf" {
+		t.Fatalf("filename = %q, want report.pdf", meta["filename"])
+	}
+	if _, ok := meta["is_confidential"]; !ok {
+		t.Fatal("expected the key without a value to be kept")
+	}
+	if _, ok := meta["bad"]; ok {
+		t.Fatal("expected the undecodable value to be dropped")
+	}
+}
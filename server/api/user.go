@@ -2,32 +2,54 @@ package api
 
 import (
 	"chat/global"
-	"chat/middleware"
 	"chat/model"
 	"chat/service"
 	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 
 	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
-// GetUserList godoc
-// @Summary      Get User List
-// @Description  Retrieves a list of users
+// ListUsers godoc
+// @Summary      Search the user directory
+// @Description  Public profiles, newest first; pass next_cursor as before to continue. q matches names starting with it, email and phone match exactly and only find users whose privacy settings allow it.
 // @Tags         User
-// @Accept       json
 // @Produce      json
+// @Param        q       query  string  false  "Name prefix"
+// @Param        email   query  string  false  "Exact email"
+// @Param        phone   query  string  false  "Exact phone"
+// @Param        before  query  int     false  "Only users with a smaller id"
+// @Param        limit   query  int     false  "Page size, default 50, max 200"
 // @Success      200  {object}  map[string]interface{}
-// @Router       /userList [get]
-func GetUserList(c *gin.Context) {
-	data := service.GetUserList()
-	c.JSON(200, gin.H{
-		"message": "User list retrieved successfully",
-		"data":    data,
-	})
+// @Router       /users [get]
+func ListUsers(c *gin.Context) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	before, limit, ok := pageQuery(c)
+	if !ok {
+		return
+	}
+	query := service.DirectoryQuery{
+		Name:  strings.TrimSpace(c.Query("q")),
+		Email: strings.TrimSpace(c.Query("email")),
+		Phone: strings.TrimSpace(c.Query("phone")),
+	}
+	users, next, err := service.SearchUsers(uid, query, before, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to list users", "error": err.Error()})
+		return
+	}
+	var cursor interface{}
+	if next > 0 {
+		cursor = next
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": users, "has_more": next > 0, "next_cursor": cursor})
 }
 
 // GetCurrentUser returns the profile of the currently authenticated user
@@ -45,6 +67,13 @@ func GetCurrentUser(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load user", "error": err.Error()})
 		return
 	}
+	// signed when the avatar is hidden from others, so it loads in <img>
+	avatar, err := service.ViewerAvatarURL(user.AvatarURL, uid, uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load user", "error": err.Error()})
+		return
+	}
+	user.AvatarURL = avatar
 	c.JSON(http.StatusOK, gin.H{"message": "ok", "data": user})
 }
 
@@ -144,14 +173,14 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	// generate token for newly registered user
-	token, terr := middleware.GenerateTokenForUser(&user)
+	// generate tokens for newly registered user
+	token, refresh, terr := issueTokens(c, &user)
 	if terr != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to generate token", "error": terr.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Register succeeded", "user_id": user.ID, "token": token})
+	c.JSON(http.StatusOK, gin.H{"message": "Register succeeded", "user_id": user.ID, "token": token, "refresh_token": refresh})
 }
 
 // Delete User
@@ -173,6 +202,9 @@ func DeleteUser(c *gin.Context) {
 		})
 		return
 	}
+	if _, ok := authorizeUserChange(c, "user.delete", uint(id), false); !ok {
+		return
+	}
 
 	user := model.UserBasic{}
 	user.ID = uint(id)
@@ -222,6 +254,10 @@ func UpdateUser(c *gin.Context) {
 		return
 	}
 
+	if _, ok := authorizeUserChange(c, "user.update", uint(id), false); !ok {
+		return
+	}
+
 	// 2. 先检查用户是否存在
 	var existingUser model.UserBasic
 	result := global.GVA_DB.First(&existingUser, id)
@@ -252,6 +288,11 @@ func UpdateUser(c *gin.Context) {
 
 	// 4. 设置要更新的字段（避免更新ID）
 	updateData.ID = uint(id)
+	if updateData.Identity != "" {
+		if _, ok := authorizeUserChange(c, "user.update", uint(id), true); !ok {
+			return
+		}
+	}
 
 	// 5. Validate fields (email/phone)
 	if err := updateData.Validate(); err != nil {
@@ -314,6 +355,16 @@ func PartialUpdateUser(c *gin.Context) {
 	delete(updateFields, "created_at")
 	delete(updateFields, "CreatedAt")
 
+	setsIdentity := false
+	for k := range updateFields {
+		if strings.EqualFold(k, "identity") {
+			setsIdentity = true
+		}
+	}
+	if _, ok := authorizeUserChange(c, "user.update", uint(id), setsIdentity); !ok {
+		return
+	}
+
 	if len(updateFields) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "No fields to update",
@@ -361,12 +412,86 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	// generate JWT token for the authenticated user
-	token, terr := middleware.GenerateTokenForUser(user)
+	// generate JWT and refresh tokens for the authenticated user
+	token, refresh, terr := issueTokens(c, user)
 	if terr != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to generate token", "error": terr.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Login succeeded", "user_id": user.ID, "token": token})
+	c.JSON(http.StatusOK, gin.H{"message": "Login succeeded", "user_id": user.ID, "token": token, "refresh_token": refresh})
+}
+
+// authorizeUserChange checks that the current user may perform action on the
+// account target: their own, unless identity is set, or one they outrank
+// with user.manage. Only admins may change Identity, the role field. A denial is audited and
+// answered with 403. It returns the current user's id.
+func authorizeUserChange(c *gin.Context, action string, target uint, identity bool) (uint, bool) {
+	uid, ok := currentUserID(c)
+	if !ok {
+		return 0, false
+	}
+	var err error
+	reason := "not the account owner, or target outranks the operator"
+	if identity {
+		err = service.CanSetIdentity(uid)
+		reason = "only admins may set identity"
+	} else {
+		err = service.CanManageUser(uid, target)
+	}
+	if errors.Is(err, service.ErrForbidden) {
+		service.AuditDenied(uid, action, target, reason, c.ClientIP())
+		c.JSON(http.StatusForbidden, gin.H{"message": "Forbidden", "error": "FORBIDDEN"})
+		return 0, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Authorization check failed", "error": err.Error()})
+		return 0, false
+	}
+	return uid, true
+}
+
+// currentUserID returns the id of the authenticated user from the JWT claims,
+// writing a 401 response when it is missing.
+func currentUserID(c *gin.Context) (uint, bool) {
+	claims := jwt.ExtractClaims(c)
+	if idf, ok := claims["id"].(float64); ok {
+		return uint(idf), true
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"message": "unauthorized"})
+	return 0, false
+}
+
+// pathID parses a positive numeric path parameter, writing a 400 response
+// when it is invalid.
+func pathID(c *gin.Context, name string) (uint, bool) {
+	id, err := strconv.Atoi(c.Param(name))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid " + name, "error": "INVALID_ID"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// pageQuery parses the before id cursor and limit of a paged list, writing a
+// 400 response when they are invalid.
+func pageQuery(c *gin.Context) (before uint, limit int, ok bool) {
+	if v := c.Query("before"); v != "" {
+		b, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || b == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "invalid before"})
+			return 0, 0, false
+		}
+		before = uint(b)
+	}
+	limit = service.DefaultPageSize
+	if v := c.Query("limit"); v != "" {
+		lv, err := strconv.Atoi(v)
+		if err != nil || lv <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "invalid limit"})
+			return 0, 0, false
+		}
+		limit = lv
+	}
+	return before, limit, true
 }
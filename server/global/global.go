@@ -3,12 +3,15 @@ package global
 import (
 	"context"
 
+	"chat/storage"
+
 	"github.com/go-redis/redis/v8"
 	"gorm.io/gorm"
 )
 
 var (
-	GVA_DB    *gorm.DB
-	GVA_REDIS *redis.Client
-	GVA_CTX   = context.Background()
+	GVA_DB      *gorm.DB
+	GVA_REDIS   *redis.Client
+	GVA_STORAGE storage.Storage
+	GVA_CTX     = context.Background()
 )
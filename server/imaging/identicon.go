@@ -0,0 +1,106 @@
+package imaging
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// identiconBackground is the colour behind the pattern of every identicon.
+var identiconBackground = color.RGBA{0xF0, 0xF0, 0xF0, 0xFF}
+
+// identicon is a 5×5 pattern, mirrored around its middle column, with a
+// single foreground colour. Half a cell of background surrounds it.
+type identicon struct {
+	fg    color.RGBA
+	cells [5][5]bool
+}
+
+// newIdenticon derives a pattern from seed; equal seeds give equal patterns.
+func newIdenticon(seed string) identicon {
+	sum := sha256.Sum256([]byte(seed))
+	hue := float64(binary.BigEndian.Uint16(sum[0:2])) / 65536 * 360
+	id := identicon{fg: hsl(hue, 0.55, 0.5)}
+	bit := 0
+	for x := 0; x < 3; x++ {
+		for y := 0; y < 5; y++ {
+			on := sum[2+bit/8]>>(bit%8)&1 == 1
+			id.cells[y][x], id.cells[y][4-x] = on, on
+			bit++
+		}
+	}
+	return id
+}
+
+// Identicon draws the identicon for seed as a size×size image.
+func Identicon(seed string, size int) *image.RGBA {
+	id := newIdenticon(seed)
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	// the grid spans six cells: five for the pattern and two half margins
+	cell := func(p int) int {
+		return int(math.Floor((float64(p)+0.5)*6/float64(size) - 0.5))
+	}
+	for py := 0; py < size; py++ {
+		y := cell(py)
+		for px := 0; px < size; px++ {
+			x := cell(px)
+			c := identiconBackground
+			if x >= 0 && x < 5 && y >= 0 && y < 5 && id.cells[y][x] {
+				c = id.fg
+			}
+			img.SetRGBA(px, py, c)
+		}
+	}
+	return img
+}
+
+// IdenticonSVG returns the identicon for seed as an SVG document of the
+// given size. It shows the same pattern as Identicon.
+func IdenticonSVG(seed string, size int) []byte {
+	id := newIdenticon(seed)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 12 12" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&b, `<rect width="12" height="12" fill="%s"/>`, hex(identiconBackground))
+	fmt.Fprintf(&b, `<g fill="%s">`, hex(id.fg))
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 5; x++ {
+			if id.cells[y][x] {
+				fmt.Fprintf(&b, `<rect x="%d" y="%d" width="2" height="2"/>`, 1+2*x, 1+2*y)
+			}
+		}
+	}
+	b.WriteString(`</g></svg>`)
+	return []byte(b.String())
+}
+
+func hex(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// hsl converts a hue in degrees, saturation and lightness to an opaque
+// colour.
+func hsl(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g = c, x
+	case h < 120:
+		r, g = x, c
+	case h < 180:
+		g, b = c, x
+	case h < 240:
+		g, b = x, c
+	case h < 300:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	return color.RGBA{uint8(math.Round((r + m) * 255)), uint8(math.Round((g + m) * 255)), uint8(math.Round((b + m) * 255)), 0xFF}
+}
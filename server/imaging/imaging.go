@@ -0,0 +1,152 @@
+// Package imaging validates, cleans and resizes uploaded images using only
+// the standard library. JPEG, PNG and GIF are supported.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+// MaxPixels bounds the decoded size of an image, guarding against small
+// files that expand into huge bitmaps.
+const MaxPixels = 40_000_000
+
+var (
+	ErrUnsupported = errors.New("unsupported image format")
+	ErrTooLarge    = errors.New("image dimensions too large")
+)
+
+// Sniff returns the content type of an image detected from its leading
+// bytes, or "" when data is not a supported image.
+func Sniff(data []byte) string {
+	switch ct := http.DetectContentType(data); ct {
+	case "image/jpeg", "image/png", "image/gif":
+		return ct
+	}
+	return ""
+}
+
+// Decode checks and decodes data. JPEG images are turned upright according
+// to their EXIF orientation.
+func Decode(data []byte) (image.Image, error) {
+	ct := Sniff(data)
+	if ct == "" {
+		return nil, ErrUnsupported
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+	var img image.Image
+	switch ct {
+	case "image/jpeg":
+		img, err = jpeg.Decode(bytes.NewReader(data))
+	case "image/png":
+		img, err = png.Decode(bytes.NewReader(data))
+	case "image/gif":
+		img, err = gif.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if ct == "image/jpeg" {
+		img = orient(img, jpegOrientation(data))
+	}
+	return img, nil
+}
+
+// toRGBA copies img into a premultiplied RGBA bitmap at the origin.
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+// resize scales src to w×h by averaging the source pixels under each
+// destination pixel, which keeps downscaled images free of aliasing.
+func resize(src *image.RGBA, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	for y := 0; y < h; y++ {
+		y0 := y * sh / h
+		y1 := max((y+1)*sh/h, y0+1)
+		for x := 0; x < w; x++ {
+			x0 := x * sw / w
+			x1 := max((x+1)*sw/w, x0+1)
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint32(p[0])
+					g += uint32(p[1])
+					b += uint32(p[2])
+					a += uint32(p[3])
+					n++
+				}
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0], d[1], d[2], d[3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// Square crops the centre of img to a square and scales it to size×size.
+func Square(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	crop := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(crop, crop.Bounds(), img, image.Pt(x0, y0), draw.Src)
+	return resize(crop, size, size)
+}
+
+// Fit scales img down to fit within limit×limit, keeping its aspect ratio.
+// Smaller images are returned at their own size.
+func Fit(img image.Image, limit int) *image.RGBA {
+	src := toRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= limit && h <= limit {
+		return src
+	}
+	if w >= h {
+		h, w = max(h*limit/w, 1), limit
+	} else {
+		w, h = max(w*limit/h, 1), limit
+	}
+	return resize(src, w, h)
+}
+
+// EncodeJPEG encodes img as a JPEG, flattening transparency onto white.
+func EncodeJPEG(img image.Image, quality int) ([]byte, error) {
+	b := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, b.Min, draw.Over)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodePNG encodes img as a PNG.
+func EncodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
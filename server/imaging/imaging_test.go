@@ -0,0 +1,152 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"testing"
+)
+
+// jpegWithOrientation encodes a w×h JPEG carrying an EXIF orientation tag.
+func jpegWithOrientation(t *testing.T, w, h, o int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), 128, 255})
+		}
+	}
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(tiff[18:], uint16(o))
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	seg := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	seg = append(seg, payload...)
+
+	data := enc.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(out, seg...)
+	return append(out, data[2:]...)
+}
+
+func TestCleanStripsExifAndAppliesOrientation(t *testing.T) {
+	upright := jpegWithOrientation(t, 40, 20, 1)
+	if got := jpegOrientation(upright); got != 1 {
+		t.Fatalf("orientation = %d, want 1", got)
+	}
+	clean, err := Clean(upright)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(clean, []byte("Exif")) {
+		t.Fatal("EXIF segment kept")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(clean)); err != nil {
+		t.Fatalf("cleaned JPEG does not decode: %v", err)
+	}
+
+	rotated, err := Clean(jpegWithOrientation(t, 40, 20, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(rotated, []byte("Exif")) {
+		t.Fatal("EXIF segment kept")
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(rotated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 20 || cfg.Height != 40 {
+		t.Fatalf("rotated size = %dx%d, want 20x40", cfg.Width, cfg.Height)
+	}
+}
+
+func TestCleanStripsGIFMetadata(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{color.Black, color.White})
+	var enc bytes.Buffer
+	if err := gif.EncodeAll(&enc, &gif.GIF{Image: []*image.Paletted{img, img}, Delay: []int{10, 10}}); err != nil {
+		t.Fatal(err)
+	}
+	data := enc.Bytes()
+	// insert a comment and an XMP extension before the first frame
+	first := bytes.Index(data, []byte{0x21, 0xF9})
+	var meta []byte
+	meta = append(meta, 0x21, 0xFE, 6)
+	meta = append(meta, "secret"...)
+	meta = append(meta, 0, 0x21, 0xFF, 11)
+	meta = append(meta, "XMP DataXMP"...)
+	meta = append(meta, 4)
+	meta = append(meta, "<xmp"...)
+	meta = append(meta, 0)
+	withMeta := append(append(append([]byte{}, data[:first]...), meta...), data[first:]...)
+
+	clean, err := Clean(withMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(clean, []byte("secret")) || bytes.Contains(clean, []byte("XMP")) {
+		t.Fatal("GIF metadata kept")
+	}
+	if !bytes.Contains(clean, []byte("NETSCAPE2.0")) {
+		t.Fatal("looping extension dropped")
+	}
+	if !bytes.Equal(clean, data) {
+		t.Fatal("image data changed")
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(clean))
+	if err != nil {
+		t.Fatalf("cleaned GIF does not decode: %v", err)
+	}
+	if len(g.Image) != 2 {
+		t.Fatalf("frames = %d, want 2", len(g.Image))
+	}
+}
+
+func TestSquareAndFit(t *testing.T) {
+	img, err := Decode(jpegWithOrientation(t, 300, 100, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := Square(img, 64).Bounds(); b.Dx() != 64 || b.Dy() != 64 {
+		t.Fatalf("square = %v", b)
+	}
+	if b := Fit(img, 150).Bounds(); b.Dx() != 150 || b.Dy() != 50 {
+		t.Fatalf("fit = %v", b)
+	}
+}
+
+func TestRejectsNonImages(t *testing.T) {
+	if _, err := Decode([]byte("<html>not an image</html>")); err != ErrUnsupported {
+		t.Fatalf("err = %v, want ErrUnsupported", err)
+	}
+	if _, err := Clean([]byte("%PDF-1.7")); err != ErrUnsupported {
+		t.Fatalf("err = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestIdenticonDeterministicAndSymmetric(t *testing.T) {
+	a, b := Identicon("7:alice", 60), Identicon("7:alice", 60)
+	if !bytes.Equal(a.Pix, b.Pix) {
+		t.Fatal("same seed drew different identicons")
+	}
+	if bytes.Equal(a.Pix, Identicon("8:alice", 60).Pix) {
+		t.Fatal("different seeds drew the same identicon")
+	}
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 30; x++ {
+			if a.RGBAAt(x, y) != a.RGBAAt(59-x, y) {
+				t.Fatalf("not mirrored at (%d,%d)", x, y)
+			}
+		}
+	}
+	if !bytes.Equal(IdenticonSVG("7:alice", 60), IdenticonSVG("7:alice", 60)) {
+		t.Fatal("same seed gave different SVGs")
+	}
+}
@@ -0,0 +1,279 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// JPEG markers that carry metadata rather than image data: APP1 (EXIF,
+// XMP), APP13 (IPTC) and comments. APP0, APP2 (ICC colour profiles) and
+// APP14 are kept because decoders need them to render colours correctly.
+var jpegMetadataMarkers = map[byte]bool{0xE1: true, 0xED: true, 0xFE: true}
+
+// PNG chunks that carry metadata.
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// GIF application extensions that are kept: looping (NETSCAPE2.0 and its
+// ANIMEXTS1.0 alias) and ICC colour profiles. Others, notably XMP, are
+// metadata; comment extensions are dropped as well.
+var gifKeptApplications = map[string]bool{"NETSCAPE2.0": true, "ANIMEXTS1.0": true, "ICCRGBG1012": true}
+
+// Clean returns data without EXIF and similar metadata. Metadata segments
+// are removed without re-encoding, except for JPEGs whose EXIF orientation
+// rotates them: those are re-encoded upright so they still display the
+// right way once the orientation tag is gone.
+func Clean(data []byte) ([]byte, error) {
+	switch Sniff(data) {
+	case "image/jpeg":
+		if o := jpegOrientation(data); o > 1 && o <= 8 {
+			img, err := Decode(data)
+			if err != nil {
+				return nil, err
+			}
+			return EncodeJPEG(img, 90)
+		}
+		return stripJPEG(data)
+	case "image/png":
+		return stripPNG(data)
+	case "image/gif":
+		return stripGIF(data)
+	}
+	return nil, ErrUnsupported
+}
+
+// jpegSegments calls fn for each marker segment before the image data with
+// the marker and the segment bytes, including marker and length. It returns
+// the offset of the start-of-scan marker.
+func jpegSegments(data []byte, fn func(marker byte, seg []byte)) (int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0, ErrUnsupported
+	}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return 0, ErrUnsupported
+		}
+		marker := data[i+1]
+		if marker == 0xFF {
+			// fill byte
+			i++
+			continue
+		}
+		if marker == 0xDA {
+			return i, nil
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return 0, ErrUnsupported
+		}
+		fn(marker, data[i:i+2+n])
+		i += 2 + n
+	}
+	return 0, ErrUnsupported
+}
+
+func stripJPEG(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	sos, err := jpegSegments(data, func(marker byte, seg []byte) {
+		if !jpegMetadataMarkers[marker] {
+			out.Write(seg)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	out.Write(data[sos:])
+	return out.Bytes(), nil
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, ErrUnsupported
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	for i := len(pngSignature); i < len(data); {
+		if i+8 > len(data) {
+			return nil, ErrUnsupported
+		}
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + n
+		if n < 0 || end > len(data) {
+			return nil, ErrUnsupported
+		}
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+func stripGIF(data []byte) ([]byte, error) {
+	// header and logical screen descriptor, then the global colour table
+	i := 13
+	if len(data) < i {
+		return nil, ErrUnsupported
+	}
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+	if i > len(data) {
+		return nil, ErrUnsupported
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:i])
+	for i < len(data) {
+		start := i
+		switch data[i] {
+		case 0x3B: // trailer
+			out.WriteByte(0x3B)
+			return out.Bytes(), nil
+		case 0x2C: // image descriptor, local colour table, LZW code size
+			if i+10 > len(data) {
+				return nil, ErrUnsupported
+			}
+			n := 10
+			if data[i+9]&0x80 != 0 {
+				n += 3 << (data[i+9]&0x07 + 1)
+			}
+			end, err := gifSubBlocks(data, i+n+1)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(data[start:end])
+			i = end
+		case 0x21: // extension
+			if i+2 > len(data) {
+				return nil, ErrUnsupported
+			}
+			end, err := gifSubBlocks(data, i+2)
+			if err != nil {
+				return nil, err
+			}
+			if !gifMetadataExtension(data[i+1], data[i+2:end]) {
+				out.Write(data[start:end])
+			}
+			i = end
+		default:
+			return nil, ErrUnsupported
+		}
+	}
+	// tolerate a missing trailer, as decoders do
+	return out.Bytes(), nil
+}
+
+// gifSubBlocks returns the offset just past the data sub-blocks starting at
+// i, including their terminator.
+func gifSubBlocks(data []byte, i int) (int, error) {
+	for {
+		if i >= len(data) {
+			return 0, ErrUnsupported
+		}
+		n := int(data[i])
+		i += 1 + n
+		if n == 0 {
+			return i, nil
+		}
+	}
+}
+
+// gifMetadataExtension reports whether the extension with label and
+// sub-blocks holds metadata.
+func gifMetadataExtension(label byte, blocks []byte) bool {
+	switch label {
+	case 0xFE: // comment
+		return true
+	case 0xFF: // application; the first sub-block names it
+		if len(blocks) < 12 || blocks[0] != 11 {
+			return true
+		}
+		return !gifKeptApplications[string(blocks[1:12])]
+	}
+	return false
+}
+
+// jpegOrientation returns the EXIF orientation tag of a JPEG, or 0 when it
+// has none.
+func jpegOrientation(data []byte) int {
+	orientation := 0
+	jpegSegments(data, func(marker byte, seg []byte) {
+		if marker != 0xE1 || orientation != 0 || !bytes.HasPrefix(seg[4:], []byte("Exif\x00\x00")) {
+			return
+		}
+		orientation = exifOrientation(seg[10:])
+	})
+	return orientation
+}
+
+// exifOrientation reads tag 0x0112 from IFD0 of a TIFF-structured EXIF block.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < count; e++ {
+		off := ifd + 2 + e*12
+		if off+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[off:]) == 0x0112 {
+			return int(order.Uint16(tiff[off+8:]))
+		}
+	}
+	return 0
+}
+
+// orient applies an EXIF orientation to img so it is displayed upright.
+func orient(img image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return img
+	}
+	src := toRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch o {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotated 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs a 90° clockwise turn
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs a 90° counter-clockwise turn
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:])
+		}
+	}
+	return dst
+}
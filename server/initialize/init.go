@@ -7,6 +7,10 @@ import (
 	"time"
 
 	"chat/global"
+	"chat/model"
+	"chat/service"
+	"chat/storage"
+	"chat/ws"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/spf13/viper"
@@ -38,16 +42,35 @@ func InitMysql() {
 		},
 	)
 
-	global.GVA_DB, _ = gorm.Open(mysql.Open(viper.GetString("Mysql.dns")), &gorm.Config{
+	db, err := gorm.Open(mysql.Open(viper.GetString("Mysql.dns")), &gorm.Config{
 		Logger: newLogger,
 	})
-	// Auto-migrate core models (messages, users) to add fields like avatar_url
-	// Note: in production you should manage migrations explicitly.
-	// It's convenient here for development purposes.
-	// Import model package to ensure types are available to GORM.
-	// Avoid circular imports by referencing via full package path if needed.
-	// Uncommenting auto-migrate for development:
-	// global.GVA_DB.AutoMigrate(&model.Message{}, &model.UserBasic{})
+	if err != nil {
+		log.Fatalf("connect to mysql: %v", err)
+	}
+	global.GVA_DB = db
+
+	// create missing tables, columns and indexes; the unique keys behind
+	// message dedupe, reactions, conversation upserts and friendships are
+	// only enforced once they exist
+	viper.SetDefault("Mysql.AutoMigrate", true)
+	if !viper.GetBool("Mysql.AutoMigrate") {
+		log.Printf("mysql auto-migration disabled; apply the schema in docs/database.md")
+		return
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		log.Fatalf("migrate mysql: %v", err)
+	}
+}
+
+// models are the tables of the server, migrated by InitMysql.
+var models = []interface{}{
+	&model.UserBasic{}, &model.Message{}, &model.MessageRevision{}, &model.MessageReaction{},
+	&model.Room{}, &model.RoomMember{}, &model.Conversation{}, &model.ReadMarker{},
+	&model.Attachment{}, &model.Upload{},
+	&model.Friendship{}, &model.UserBlock{}, &model.PrivacySettings{},
+	&model.Session{}, &model.AuditLog{},
+	&model.Role{}, &model.Permission{}, &model.RolePermission{}, &model.UserRole{},
 }
 
 func InitRedis() {
@@ -75,3 +98,122 @@ func InitRedis() {
 	// store context as global.GVA_CTX already set in global package
 	_ = ctx
 }
+
+// InitHub creates the websocket hub and starts it. With Redis configured the
+// hub fans messages out to other instances over pub/sub, or over Redis Streams
+// when Hub.Broker is "streams".
+func InitHub() {
+	var broker ws.Broker
+	if global.GVA_REDIS != nil {
+		switch viper.GetString("Hub.Broker") {
+		case "streams":
+			// hostnames change with every deployment on most orchestrators,
+			// and each new name would start a fresh consumer group at "$"
+			instance := viper.GetString("Hub.InstanceID")
+			if instance == "" {
+				log.Fatal("Hub.InstanceID is required with the streams broker")
+			}
+			broker = ws.NewStreamBroker(global.GVA_REDIS, instance, viper.GetInt64("Hub.StreamMaxLen"))
+			log.Printf("hub broker: redis streams (instance %s)", instance)
+		default:
+			broker = ws.NewRedisBroker(global.GVA_REDIS)
+		}
+	}
+	ws.DefaultHub = ws.NewHub(broker)
+	go ws.DefaultHub.Run()
+}
+
+// InitStorage selects the attachment storage driver from config.
+func InitStorage() {
+	switch driver := viper.GetString("Storage.Driver"); driver {
+	case "s3":
+		s, err := storage.NewS3(storage.S3Config{
+			Endpoint:  viper.GetString("Storage.S3.Endpoint"),
+			Region:    viper.GetString("Storage.S3.Region"),
+			Bucket:    viper.GetString("Storage.S3.Bucket"),
+			AccessKey: viper.GetString("Storage.S3.AccessKey"),
+			SecretKey: viper.GetString("Storage.S3.SecretKey"),
+			PathStyle: viper.GetBool("Storage.S3.PathStyle"),
+		})
+		if err != nil {
+			log.Fatalf("storage init failed: %v", err)
+		}
+		global.GVA_STORAGE = s
+	case "", "local":
+		root := viper.GetString("Storage.Local.Root")
+		if root == "" {
+			root = "uploads"
+		}
+		global.GVA_STORAGE = storage.NewLocal(root)
+	default:
+		log.Fatalf("unknown storage driver %q", driver)
+	}
+	if max := viper.GetInt64("Attachments.MaxSize"); max > 0 {
+		service.AttachmentMaxSize = max
+	}
+}
+
+// InitUploads applies the resumable upload settings and purges abandoned
+// uploads in the background.
+func InitUploads() {
+	if dir := viper.GetString("Uploads.Dir"); dir != "" {
+		service.UploadDir = dir
+	}
+	if max := viper.GetInt64("Uploads.MaxSize"); max > 0 {
+		service.UploadMaxSize = max
+	}
+	if quota := viper.GetInt64("Uploads.Quota"); quota > 0 {
+		service.UploadQuota = quota
+	}
+	if expiry := viper.GetDuration("Uploads.Expiry"); expiry > 0 {
+		service.UploadExpiry = expiry
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			service.PurgeUploads()
+		}
+	}()
+}
+
+// InitContacts applies the contact settings.
+func InitContacts() {
+	service.ContactsOnlyDirectMessages = viper.GetBool("Contacts.OnlyDirectMessages")
+}
+
+// InitSessions applies the session settings and purges dead refresh tokens
+// in the background.
+func InitSessions() {
+	if ttl := viper.GetDuration("Auth.RefreshTokenTTL"); ttl > 0 {
+		service.RefreshTokenTTL = ttl
+	}
+	if keep := viper.GetDuration("Auth.RotatedTokenRetention"); keep > 0 {
+		service.RotatedTokenRetention = keep
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			service.PurgeSessions()
+		}
+	}()
+}
+
+// InitConversations creates, in the background, the inbox summaries of
+// conversations that predate them.
+func InitConversations() {
+	go func() {
+		n, err := service.BackfillConversations()
+		if err != nil {
+			log.Printf("backfill conversations: %v", err)
+			return
+		}
+		if n > 0 {
+			log.Printf("backfilled %d conversation summaries", n)
+		}
+	}()
+}
+
+// InitRBAC creates the built-in permissions and roles.
+func InitRBAC() {
+	if err := service.SeedRBAC(); err != nil {
+		log.Printf("seed roles and permissions: %v", err)
+	}
+}
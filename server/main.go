@@ -8,7 +8,14 @@ import (
 func main() {
 	initialize.InitConfig()
 	initialize.InitMysql()
+	initialize.InitRBAC()
+	initialize.InitConversations()
+	initialize.InitSessions()
 	initialize.InitRedis()
+	initialize.InitStorage()
+	initialize.InitUploads()
+	initialize.InitContacts()
+	initialize.InitHub()
 	r := router.Router()
 	r.Run() // listen and serve on 0.0.0.0:8080 (for windows "localhost:8080")
 }
@@ -1,7 +1,9 @@
 package middleware
 
 import (
+	"errors"
 	"log"
+	"net/http"
 	"os"
 	"time"
 
@@ -17,6 +19,9 @@ import (
 
 var identityKey = "id"
 
+// authErrorKey holds the reason the Authorizator rejected a request.
+const authErrorKey = "auth_error"
+
 // JWTMiddleware returns a configured Gin-JWT middleware instance.
 func JWTMiddleware() *jwt.GinJWTMiddleware {
 	authMiddleware, err := jwt.New(&jwt.GinJWTMiddleware{
@@ -54,13 +59,37 @@ func JWTMiddleware() *jwt.GinJWTMiddleware {
 			}
 			return user, nil
 		},
+		// Authorizator rejects tokens of suspended accounts, tokens issued
+		// before the account's tokens were revoked and tokens of ended
+		// sessions.
 		Authorizator: func(data interface{}, c *gin.Context) bool {
-			if _, ok := data.(*model.UserBasic); ok {
-				return true
+			user, ok := data.(*model.UserBasic)
+			if !ok || user.ID == 0 {
+				return false
+			}
+			claims := jwt.ExtractClaims(c)
+			iat, _ := claims["iat"].(float64)
+			sid, _ := claims["sid"].(string)
+			if err := service.CheckTokenAccess(user.ID, int64(iat), sid); err != nil {
+				c.Set(authErrorKey, err)
+				return false
 			}
-			return false
+			return true
 		},
 		Unauthorized: func(c *gin.Context, code int, message string) {
+			if v, ok := c.Get(authErrorKey); ok {
+				switch err := v.(error); {
+				case errors.Is(err, service.ErrSuspended):
+					c.JSON(http.StatusForbidden, gin.H{"message": "Account suspended", "error": "ACCOUNT_SUSPENDED"})
+					return
+				case errors.Is(err, service.ErrTokenRevoked):
+					c.JSON(http.StatusUnauthorized, gin.H{"message": "Token revoked", "error": "TOKEN_REVOKED"})
+					return
+				default:
+					c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+					return
+				}
+			}
 			c.JSON(code, gin.H{"message": message})
 		},
 		TokenLookup:   "header: Authorization, query: token, cookie: jwt",
@@ -80,15 +109,19 @@ func getSecret() string {
 	return "secret"
 }
 
-// GenerateTokenForUser creates a signed JWT for the given user using the same
-// identity key and secret as the middleware. The token expires in 1 hour.
-func GenerateTokenForUser(user *model.UserBasic) (string, error) {
+// GenerateTokenForUser creates a signed JWT for the given user and session
+// using the same identity key and secret as the middleware. The token
+// expires in 1 hour; clients renew it with their refresh token.
+func GenerateTokenForUser(user *model.UserBasic, sid string) (string, error) {
 	if user == nil {
 		return "", nil
 	}
 	claims := jwtv.MapClaims{}
+	now := time.Now()
 	claims[identityKey] = user.ID
-	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	claims["iat"] = now.Unix()
+	claims["sid"] = sid
+	claims["exp"] = now.Add(time.Hour).Unix()
 	token := jwtv.NewWithClaims(jwtv.SigningMethodHS256, claims)
 	return token.SignedString([]byte(getSecret()))
 }
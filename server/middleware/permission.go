@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+
+	"chat/service"
+)
+
+// RequirePermission only lets users holding perm through. It runs after the
+// JWT middleware; denials are answered with 403 and audited.
+func RequirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idf, ok := jwt.ExtractClaims(c)[identityKey].(float64)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "unauthorized"})
+			return
+		}
+		uid := uint(idf)
+		err := service.RequirePermission(uid, perm)
+		if errors.Is(err, service.ErrForbidden) {
+			service.AuditDenied(uid, c.Request.Method+" "+c.FullPath(), 0, "missing permission "+perm, c.ClientIP())
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "Forbidden", "error": "FORBIDDEN"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Authorization check failed", "error": err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
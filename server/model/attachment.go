@@ -0,0 +1,25 @@
+package model
+
+import "gorm.io/gorm"
+
+// Attachment is an uploaded file. Its contents live in storage under Key,
+// with a JPEG thumbnail under ThumbKey for images. MessageID is set once the
+// file has been sent in a message, which grants the participants of that
+// conversation access to it.
+type Attachment struct {
+	gorm.Model
+	OwnerID     uint   `json:"owner_id" gorm:"index"`
+	MessageID   *uint  `json:"message_id,omitempty" gorm:"index"`
+	Key         string `json:"-" gorm:"size:255;uniqueIndex"`
+	Name        string `json:"name" gorm:"size:255"`
+	ContentType string `json:"content_type" gorm:"size:128"`
+	Size        int64  `json:"size"`
+	// Width, Height and ThumbKey are set for images.
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	ThumbKey string `json:"-" gorm:"size:255"`
+}
+
+func (Attachment) TableName() string {
+	return "attachments"
+}
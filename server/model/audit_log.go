@@ -0,0 +1,26 @@
+package model
+
+import "time"
+
+// Audit outcomes.
+const (
+	AuditAllowed = "allowed"
+	AuditDenied  = "denied"
+)
+
+// AuditLog records an attempt to perform a privileged action.
+type AuditLog struct {
+	ID       uint   `json:"id" gorm:"primarykey"`
+	ActorID  uint   `json:"actor_id" gorm:"index"`
+	Action   string `json:"action" gorm:"size:64"`
+	TargetID uint   `json:"target_id,omitempty"`
+	Outcome  string `json:"outcome" gorm:"size:16"`
+	// Detail says why an attempt was denied, or what it changed.
+	Detail    string    `json:"detail,omitempty" gorm:"size:255"`
+	IP        string    `json:"ip,omitempty" gorm:"size:45"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
+
+func (AuditLog) TableName() string {
+	return "audit_logs"
+}
@@ -0,0 +1,39 @@
+package model
+
+import "time"
+
+// UserBlock records that UserID blocked BlockedID. Either side of a block
+// can no longer message, befriend or watch the presence of the other.
+type UserBlock struct {
+	ID        uint      `json:"-" gorm:"primarykey"`
+	UserID    uint      `json:"user_id" gorm:"uniqueIndex:idx_user_blocks_pair,priority:1"`
+	BlockedID uint      `json:"blocked_id" gorm:"uniqueIndex:idx_user_blocks_pair,priority:2;index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (UserBlock) TableName() string {
+	return "user_blocks"
+}
+
+// Audiences of a privacy setting.
+const (
+	VisibleEveryone = "everyone"
+	VisibleContacts = "contacts"
+	VisibleNobody   = "nobody"
+)
+
+// PrivacySettings chooses who may see parts of a user's profile. Users
+// without a row see the defaults, where everything is visible to everyone.
+type PrivacySettings struct {
+	UserID   uint   `json:"user_id" gorm:"primarykey;autoIncrement:false"`
+	LastSeen string `json:"last_seen" gorm:"size:16"`
+	Avatar   string `json:"avatar" gorm:"size:16"`
+	// ContactLookup chooses who may find the user by exact email or phone
+	// in the user directory.
+	ContactLookup string    `json:"contact_lookup" gorm:"size:16"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func (PrivacySettings) TableName() string {
+	return "privacy_settings"
+}
@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+// Conversation summarises one direct peer or room for one user. Rows are
+// upserted whenever a message is stored so the inbox can be listed without
+// scanning the messages table.
+type Conversation struct {
+	ID      uint   `json:"id" gorm:"primarykey"`
+	OwnerID uint   `json:"owner_id" gorm:"uniqueIndex:idx_conversations_key,priority:1;index:idx_conversations_owner_last,priority:1"`
+	PeerID  uint   `json:"peer_id,omitempty" gorm:"uniqueIndex:idx_conversations_key,priority:2"`
+	Room    string `json:"room,omitempty" gorm:"size:64;uniqueIndex:idx_conversations_key,priority:3"`
+
+	LastMessageID uint      `json:"last_message_id" gorm:"index:idx_conversations_owner_last,priority:2"`
+	LastFrom      uint      `json:"last_from"`
+	LastType      string    `json:"last_type" gorm:"size:32"`
+	LastPreview   string    `json:"last_preview" gorm:"size:255"`
+	LastAt        time.Time `json:"last_at"`
+	Unread        int       `json:"unread"`
+}
+
+func (Conversation) TableName() string {
+	return "conversations"
+}
@@ -0,0 +1,39 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// Friendship statuses. Declined requests and removed friendships are
+// deleted rather than kept with a status of their own.
+const (
+	FriendshipPending  = "pending"
+	FriendshipAccepted = "accepted"
+)
+
+// Friendship links two users. RequesterID asked AddresseeID to become
+// contacts; the friendship is pending until the addressee accepts.
+type Friendship struct {
+	ID          uint `json:"-" gorm:"primarykey"`
+	RequesterID uint `json:"requester_id" gorm:"index"`
+	AddresseeID uint `json:"addressee_id" gorm:"index"`
+	// Pair is the two user ids in ascending order; it keeps a single row
+	// per pair of users whoever asked first.
+	Pair       string     `json:"-" gorm:"size:41;uniqueIndex"`
+	Status     string     `json:"status" gorm:"size:16"`
+	CreatedAt  time.Time  `json:"created_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+}
+
+func (Friendship) TableName() string {
+	return "friendships"
+}
+
+// FriendPair returns the Pair key of a friendship between a and b.
+func FriendPair(a, b uint) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%d:%d", a, b)
+}
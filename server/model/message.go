@@ -9,15 +9,68 @@ import (
 // Message persists chat messages and delivery metadata.
 type Message struct {
 	gorm.Model
-	From        uint       `json:"from" gorm:"index"`
-	To          uint       `json:"to,omitempty" gorm:"index"`
+	From        uint       `json:"from" gorm:"index;uniqueIndex:idx_messages_client_msg,priority:1"`
+	To          uint       `json:"to,omitempty" gorm:"index;index:idx_messages_undelivered,priority:1"`
 	Room        string     `json:"room,omitempty" gorm:"index"`
 	Type        string     `json:"type"`
 	Body        string     `json:"body" gorm:"type:text"`
-	Delivered   bool       `json:"delivered"`
+	Delivered   bool       `json:"delivered" gorm:"index:idx_messages_undelivered,priority:2"`
 	DeliveredAt *time.Time `json:"delivered_at"`
+	// ReadAt is when the recipient of a direct message read it. Room
+	// messages use read markers instead.
+	ReadAt *time.Time `json:"read_at"`
+	// ClientMsgID is chosen by the sender to make retries idempotent. It is
+	// unique per sender; NULL for messages sent without one.
+	ClientMsgID *string `json:"client_msg_id,omitempty" gorm:"size:64;uniqueIndex:idx_messages_client_msg,priority:2"`
+	// EditedAt is set when the sender last changed Body; earlier bodies are
+	// kept as MessageRevisions.
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	// Tombstone marks a message deleted by its sender. The row stays so
+	// history keeps its place, but Body is cleared.
+	Tombstone bool `json:"tombstone,omitempty"`
+	// ReplyTo is the message this one answers and ThreadRoot the first
+	// message of its thread; both are zero outside threads.
+	ReplyTo    uint `json:"reply_to,omitempty"`
+	ThreadRoot uint `json:"thread_root,omitempty" gorm:"index"`
+	// ReplyCount and LastReplyAt are kept on thread roots.
+	ReplyCount  int        `json:"reply_count,omitempty"`
+	LastReplyAt *time.Time `json:"last_reply_at,omitempty"`
+	// Reactions summarises message_reactions when loaded with history.
+	Reactions []ReactionSummary `json:"reactions,omitempty" gorm:"-"`
 }
 
 func (Message) TableName() string {
 	return "messages"
 }
+
+// MessageRevision is a previous body of an edited message.
+type MessageRevision struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	MessageID uint      `json:"message_id" gorm:"index"`
+	Body      string    `json:"body" gorm:"type:text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (MessageRevision) TableName() string {
+	return "message_revisions"
+}
+
+// MessageReaction is one user's emoji reaction to a message.
+type MessageReaction struct {
+	ID        uint      `json:"-" gorm:"primarykey"`
+	MessageID uint      `json:"message_id" gorm:"uniqueIndex:idx_message_reactions_key,priority:1"`
+	UserID    uint      `json:"user_id" gorm:"uniqueIndex:idx_message_reactions_key,priority:2"`
+	Emoji     string    `json:"emoji" gorm:"size:64;uniqueIndex:idx_message_reactions_key,priority:3"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (MessageReaction) TableName() string {
+	return "message_reactions"
+}
+
+// ReactionSummary counts the users who reacted to a message with one emoji.
+type ReactionSummary struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Users []uint `json:"users"`
+}
@@ -0,0 +1,65 @@
+package model
+
+import "time"
+
+// Permissions granted through roles. Administrators, users whose Identity is
+// IdentityAdmin or who hold RoleAdmin, hold all of them.
+const (
+	// PermUserManage allows changing, suspending and logging out any account.
+	PermUserManage = "user.manage"
+	// PermRoleManage allows granting and revoking roles.
+	PermRoleManage = "role.manage"
+	// PermRoomModerate allows removing members from any room.
+	PermRoomModerate = "room.moderate"
+	// PermMessageDeleteAny allows deleting messages sent by others.
+	PermMessageDeleteAny = "message.delete_any"
+)
+
+// RoleAdmin is the role that makes its holders administrators, like the
+// admin Identity.
+const RoleAdmin = "admin"
+
+// Role is a named set of permissions.
+type Role struct {
+	ID          uint      `json:"id" gorm:"primarykey"`
+	Name        string    `json:"name" gorm:"size:64;uniqueIndex"`
+	Description string    `json:"description" gorm:"size:255"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (Role) TableName() string {
+	return "roles"
+}
+
+// Permission names an action that roles can allow.
+type Permission struct {
+	ID          uint   `json:"id" gorm:"primarykey"`
+	Name        string `json:"name" gorm:"size:64;uniqueIndex"`
+	Description string `json:"description" gorm:"size:255"`
+}
+
+func (Permission) TableName() string {
+	return "permissions"
+}
+
+// RolePermission grants a permission to a role.
+type RolePermission struct {
+	RoleID       uint `gorm:"primarykey;autoIncrement:false"`
+	PermissionID uint `gorm:"primarykey;autoIncrement:false;index"`
+}
+
+func (RolePermission) TableName() string {
+	return "role_permissions"
+}
+
+// UserRole grants a role to a user.
+type UserRole struct {
+	UserID    uint      `json:"user_id" gorm:"primarykey;autoIncrement:false"`
+	RoleID    uint      `json:"role_id" gorm:"primarykey;autoIncrement:false;index"`
+	GrantedBy uint      `json:"granted_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (UserRole) TableName() string {
+	return "user_roles"
+}
@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// ReadMarker is a user's read watermark in one conversation: every message up
+// to and including LastReadID has been read. Direct conversations set PeerID,
+// room conversations set Room.
+type ReadMarker struct {
+	ID         uint      `json:"-" gorm:"primarykey"`
+	UserID     uint      `json:"user_id" gorm:"uniqueIndex:idx_read_markers_key,priority:1"`
+	PeerID     uint      `json:"peer_id,omitempty" gorm:"uniqueIndex:idx_read_markers_key,priority:2"`
+	Room       string    `json:"room,omitempty" gorm:"size:64;uniqueIndex:idx_read_markers_key,priority:3"`
+	LastReadID uint      `json:"last_read_id"`
+	ReadAt     time.Time `json:"read_at"`
+}
+
+func (ReadMarker) TableName() string {
+	return "read_markers"
+}
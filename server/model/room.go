@@ -0,0 +1,44 @@
+package model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Room member roles, from most to least privileged.
+const (
+	RoomRoleOwner  = "owner"
+	RoomRoleAdmin  = "admin"
+	RoomRoleMember = "member"
+)
+
+// Room is a persistent group conversation. Its ID in decimal is the room_id
+// used on the websocket and stored in Message.Room.
+type Room struct {
+	gorm.Model
+	Name    string `json:"name" gorm:"size:128"`
+	OwnerID uint   `json:"owner_id" gorm:"index"`
+}
+
+func (Room) TableName() string {
+	return "rooms"
+}
+
+// RoomMember grants a user access to a room with a role.
+type RoomMember struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	RoomID    uint      `json:"room_id" gorm:"uniqueIndex:idx_room_members_room_user,priority:1"`
+	UserID    uint      `json:"user_id" gorm:"uniqueIndex:idx_room_members_room_user,priority:2;index"`
+	Role      string    `json:"role" gorm:"size:16"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (RoomMember) TableName() string {
+	return "room_members"
+}
+
+// CanManage reports whether the member may invite and remove others.
+func (m *RoomMember) CanManage() bool {
+	return m.Role == RoomRoleOwner || m.Role == RoomRoleAdmin
+}
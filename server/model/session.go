@@ -0,0 +1,25 @@
+package model
+
+import "time"
+
+// Session is one refresh token. Every token issued for a login, from the
+// first to the latest rotation, shares the FamilyID, which access tokens
+// carry as their sid claim. Only a hash of the token is stored.
+type Session struct {
+	ID        uint      `json:"-" gorm:"primarykey"`
+	UserID    uint      `json:"user_id" gorm:"index"`
+	FamilyID  string    `json:"family_id" gorm:"size:32;index"`
+	TokenHash string    `json:"-" gorm:"size:64;uniqueIndex"`
+	IP        string    `json:"ip" gorm:"size:64"`
+	UserAgent string    `json:"user_agent" gorm:"size:255"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// RotatedAt is set once the token was exchanged for a new one; seeing
+	// it again means it leaked.
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (Session) TableName() string {
+	return "sessions"
+}
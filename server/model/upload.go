@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// Upload is a resumable upload in progress. The bytes received so far are
+// kept in a partial file named after ID until Offset reaches Length, when
+// the file is moved into storage as AttachmentID.
+type Upload struct {
+	ID           string    `json:"id" gorm:"primarykey;size:32"`
+	OwnerID      uint      `json:"owner_id" gorm:"index"`
+	Length       int64     `json:"length"`
+	Offset       int64     `json:"offset"`
+	Name         string    `json:"name" gorm:"size:255"`
+	AttachmentID *uint     `json:"attachment_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" gorm:"index"`
+}
+
+func (Upload) TableName() string {
+	return "uploads"
+}
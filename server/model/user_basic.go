@@ -3,13 +3,16 @@ package model
 import (
 	"errors"
 	"regexp"
-
-	"chat/global"
+	"time"
 
 	"github.com/asaskevich/govalidator"
 	"gorm.io/gorm"
 )
 
+// IdentityAdmin is the Identity of administrators, who may manage every
+// account. Other users have an empty Identity.
+const IdentityAdmin = "admin"
+
 type UserBasic struct {
 	gorm.Model
 	Name          string
@@ -25,17 +28,20 @@ type UserBasic struct {
 	LogoutTime    uint64
 	IsLogout      bool
 	DeviceInfo    string
+	// SuspendedAt is set while an operator has suspended the account; a
+	// suspended user can neither log in nor use existing tokens.
+	SuspendedAt *time.Time
+	// TokensRevokedAt rejects every token issued before it (Unix seconds).
+	TokensRevokedAt uint64
 }
 
 func (table *UserBasic) TableName() string {
 	return "user_basic"
 }
 
-func GetUserList() []*UserBasic {
-	var users []*UserBasic
-	db := global.GVA_DB
-	db.Find(&users)
-	return users
+// IsAdmin reports whether u has the admin role.
+func (u *UserBasic) IsAdmin() bool {
+	return u.Identity == IdentityAdmin
 }
 
 // Validate checks email and phone fields using govalidator.
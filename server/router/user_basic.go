@@ -4,6 +4,7 @@ import (
 	"chat/api"
 	"chat/docs"
 	"chat/middleware"
+	"chat/model"
 	"chat/ws"
 
 	"github.com/gin-gonic/gin"
@@ -22,7 +23,8 @@ func Router() *gin.Engine {
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
 	r.GET("/index", api.GetIndex)
-	r.GET("/userList", api.GetUserList)
+	// avatars are loaded by <img> tags, which cannot send the JWT
+	r.GET("/avatar/:id", api.GetAvatar)
 	// legacy GET create route removed in favor of JSON POST register
 	r.POST("/user/register", api.Register)
 	r.GET("/ws", func(c *gin.Context) { ws.ServeWS(c.Writer, c.Request) })
@@ -33,16 +35,78 @@ func Router() *gin.Engine {
 	authMiddleware := middleware.JWTMiddleware()
 	// use our API Login handler which returns token + user_id
 	r.POST("/user/login", api.Login)
+	// the access token may have expired by the time it is refreshed
+	r.POST("/auth/refresh", api.RefreshToken)
+	// tus discovery is unauthenticated, like a CORS preflight
+	r.OPTIONS("/uploads", api.UploadOptions)
 
 	// protected routes
 	auth := r.Group("/")
 	auth.Use(authMiddleware.MiddlewareFunc())
+	auth.POST("/auth/logout", api.Logout)
 	auth.DELETE("/user/:id", api.DeleteUser)
 	auth.GET("/messages", api.GetMessages)
+	auth.PUT("/messages/:id", api.EditMessage)
+	auth.DELETE("/messages/:id", api.DeleteMessage)
+	auth.GET("/messages/:id/reads", api.GetMessageReads)
+	auth.GET("/messages/:id/thread", api.GetThread)
+	auth.POST("/messages/:id/reactions", api.AddReaction)
+	auth.DELETE("/messages/:id/reactions/:emoji", api.RemoveReaction)
 	auth.POST("/user/avatar", api.UploadAvatar)
 	auth.GET("/user/me", api.GetCurrentUser)
 	auth.PUT("/user/:id", api.UpdateUser)
 	auth.PATCH("/user/:id", api.PartialUpdateUser)
+	auth.GET("/user/privacy", api.GetPrivacy)
+	auth.PUT("/user/privacy", api.UpdatePrivacy)
+
+	// attachments
+	auth.POST("/attachments", api.UploadAttachment)
+	auth.GET("/attachments/:id", api.DownloadAttachment)
+	auth.GET("/attachments/:id/thumbnail", api.DownloadThumbnail)
+
+	// resumable uploads (tus)
+	auth.POST("/uploads", api.CreateUpload)
+	auth.HEAD("/uploads/:id", api.UploadStatus)
+	auth.PATCH("/uploads/:id", api.WriteUpload)
+	auth.DELETE("/uploads/:id", api.DeleteUpload)
+
+	// directory and presence
+	auth.GET("/users", api.ListUsers)
+	auth.GET("/users/:id/presence", api.GetPresence)
+
+	// contacts
+	auth.GET("/friends", api.ListFriends)
+	auth.POST("/friends/requests", api.RequestFriend)
+	auth.POST("/friends/requests/:user_id/accept", api.AcceptFriend)
+	auth.POST("/friends/requests/:user_id/decline", api.DeclineFriend)
+	auth.DELETE("/friends/:user_id", api.RemoveFriend)
+	auth.GET("/blocks", api.ListBlocks)
+	auth.POST("/blocks", api.BlockUser)
+	auth.DELETE("/blocks/:user_id", api.UnblockUser)
+
+	// conversations
+	auth.GET("/conversations", api.ListConversations)
+	auth.POST("/conversations/read", api.MarkConversationRead)
+
+	// rooms
+	auth.POST("/rooms", api.CreateRoom)
+	auth.GET("/rooms", api.ListRooms)
+	auth.GET("/rooms/:id/messages", api.GetRoomMessages)
+	auth.GET("/rooms/:id/members", api.ListRoomMembers)
+	auth.POST("/rooms/:id/members", api.AddRoomMember)
+	auth.DELETE("/rooms/:id/members/:user_id", api.RemoveRoomMember)
+
+	// operators
+	admin := auth.Group("/admin")
+	users := admin.Group("/users", middleware.RequirePermission(model.PermUserManage))
+	users.GET("", api.AdminListUsers)
+	users.POST("/:id/suspend", api.AdminSuspendUser)
+	users.POST("/:id/restore", api.AdminRestoreUser)
+	users.POST("/:id/logout", api.AdminLogoutUser)
+	roles := admin.Group("", middleware.RequirePermission(model.PermRoleManage))
+	roles.GET("/roles", api.AdminListRoles)
+	roles.POST("/users/:id/roles", api.AdminGrantRole)
+	roles.DELETE("/users/:id/roles/:role", api.AdminRevokeRole)
 
 	return r
 }
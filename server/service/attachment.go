@@ -0,0 +1,263 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"chat/global"
+	"chat/imaging"
+	"chat/model"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrAttachmentTooLarge = errors.New("attachment too large")
+	ErrAttachmentUsed     = errors.New("attachment already sent")
+	ErrInvalidImage       = errors.New("file looks like an image but could not be decoded")
+	ErrImageTooLarge      = errors.New("image too large to process")
+)
+
+// AttachmentMaxSize is the largest accepted upload in bytes. It is set from
+// config at startup.
+var AttachmentMaxSize int64 = 25 << 20
+
+// AttachmentBody is the structured body of an "attachment" message. Clients
+// send AttachmentID and an optional Caption; the server fills in the rest.
+type AttachmentBody struct {
+	AttachmentID uint   `json:"attachment_id"`
+	Caption      string `json:"caption,omitempty"`
+	Name         string `json:"name,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	URL          string `json:"url,omitempty"`
+	// set for images
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+// newObjectKey returns a fresh storage key below prefix for ownerID.
+func newObjectKey(prefix string, ownerID uint) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("object key: %v", err)
+	}
+	return fmt.Sprintf("%s/%d/%s", prefix, ownerID, hex.EncodeToString(b))
+}
+
+// cleanFileName keeps the base name of a client-supplied file name.
+func cleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" {
+		name = "file"
+	}
+	if r := []rune(name); len(r) > 200 {
+		name = string(r[:200])
+	}
+	return name
+}
+
+// CreateAttachment stores size bytes from r as a new attachment owned by
+// ownerID. The content type is sniffed from the data rather than trusted
+// from the client.
+func CreateAttachment(ownerID uint, name string, r io.Reader, size int64) (*model.Attachment, error) {
+	if size > AttachmentMaxSize {
+		return nil, ErrAttachmentTooLarge
+	}
+	// fail before storing anything; storeAttachment checks again
+	used, err := usedBytes(global.GVA_DB, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if used+size > UploadQuota {
+		return nil, ErrQuotaExceeded
+	}
+	return storeAttachment(ownerID, name, r, size, true)
+}
+
+// storeAttachment puts size bytes from r into storage and records them as an
+// attachment, without applying the single-request size limit. Images are
+// stripped of metadata and get a thumbnail; those too large to process are
+// rejected rather than stored with their metadata. With quota set, the
+// attachment is only recorded if it fits the owner's quota.
+func storeAttachment(ownerID uint, name string, r io.Reader, size int64, quota bool) (*model.Attachment, error) {
+	br := bufio.NewReaderSize(r, 512)
+	head, _ := br.Peek(512)
+	a := &model.Attachment{
+		OwnerID:     ownerID,
+		Key:         newObjectKey("attachments", ownerID),
+		Name:        cleanFileName(name),
+		ContentType: http.DetectContentType(head),
+		Size:        size,
+	}
+	ctx := context.Background()
+	var body io.Reader = br
+	var thumb []byte
+	if imaging.Sniff(head) != "" {
+		if size > maxProcessedImage {
+			return nil, ErrImageTooLarge
+		}
+		data, err := io.ReadAll(io.LimitReader(br, size))
+		if err != nil {
+			return nil, err
+		}
+		if data, thumb, err = processImage(a, data); err != nil {
+			return nil, err
+		}
+		body, a.Size = bytes.NewReader(data), int64(len(data))
+	}
+	if err := global.GVA_STORAGE.Put(ctx, a.Key, body, a.Size, a.ContentType); err != nil {
+		return nil, err
+	}
+	if thumb != nil {
+		a.ThumbKey = a.Key + ".thumb"
+		if err := global.GVA_STORAGE.Put(ctx, a.ThumbKey, bytes.NewReader(thumb), int64(len(thumb)), "image/jpeg"); err != nil {
+			log.Printf("store thumbnail %s: %v", a.ThumbKey, err)
+			a.ThumbKey = ""
+		}
+	}
+	create := func(tx *gorm.DB) error { return tx.Create(a).Error }
+	var err error
+	if quota {
+		err = withinQuota(ownerID, a.Size, create)
+	} else {
+		err = create(global.GVA_DB)
+	}
+	if err != nil {
+		for _, key := range []string{a.Key, a.ThumbKey} {
+			if key == "" {
+				continue
+			}
+			if derr := global.GVA_STORAGE.Delete(ctx, key); derr != nil {
+				log.Printf("delete orphaned object %s: %v", key, derr)
+			}
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// Images larger than this are rejected, to bound the memory used per
+// upload.
+const maxProcessedImage = 32 << 20
+
+// Longest side of attachment thumbnails.
+const thumbnailSize = 320
+
+// processImage strips the metadata of image attachment a, records its
+// dimensions and returns the cleaned data with a JPEG thumbnail.
+func processImage(a *model.Attachment, data []byte) ([]byte, []byte, error) {
+	clean, err := imaging.Clean(data)
+	if err != nil {
+		return nil, nil, ErrInvalidImage
+	}
+	img, err := imaging.Decode(clean)
+	if err != nil {
+		return nil, nil, ErrInvalidImage
+	}
+	a.Width, a.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	thumb, err := imaging.EncodeJPEG(imaging.Fit(img, thumbnailSize), 80)
+	if err != nil {
+		return nil, nil, err
+	}
+	return clean, thumb, nil
+}
+
+// GetAttachment returns attachment id if userID may read it: its owner, or a
+// participant of the conversation it was sent in.
+func GetAttachment(userID, id uint) (*model.Attachment, error) {
+	var a model.Attachment
+	if err := global.GVA_DB.First(&a, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, err
+	}
+	if a.OwnerID == userID {
+		return &a, nil
+	}
+	if a.MessageID == nil {
+		return nil, ErrAttachmentNotFound
+	}
+	var m model.Message
+	if err := global.GVA_DB.First(&m, *a.MessageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, err
+	}
+	if _, _, err := conversationOf(&m, userID); err != nil {
+		return nil, ErrNotParticipant
+	}
+	return &a, nil
+}
+
+// OpenAttachment opens the stored contents of a, or of its thumbnail.
+func OpenAttachment(a *model.Attachment, thumbnail bool) (io.ReadCloser, error) {
+	key := a.Key
+	if thumbnail {
+		if a.ThumbKey == "" {
+			return nil, ErrAttachmentNotFound
+		}
+		key = a.ThumbKey
+	}
+	return global.GVA_STORAGE.Get(context.Background(), key)
+}
+
+// PrepareAttachmentBody validates the body of an "attachment" message sent
+// by userID and returns it completed with the file's metadata, along with
+// the attachment id.
+func PrepareAttachmentBody(userID uint, body string) (string, uint, error) {
+	var ab AttachmentBody
+	if err := json.Unmarshal([]byte(body), &ab); err != nil || ab.AttachmentID == 0 {
+		return "", 0, fmt.Errorf("attachment body must be a JSON object with attachment_id")
+	}
+	var a model.Attachment
+	if err := global.GVA_DB.Where("id = ? AND owner_id = ?", ab.AttachmentID, userID).First(&a).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", 0, ErrAttachmentNotFound
+		}
+		return "", 0, err
+	}
+	if a.MessageID != nil {
+		return "", 0, ErrAttachmentUsed
+	}
+	ab.Name, ab.ContentType, ab.Size = a.Name, a.ContentType, a.Size
+	ab.URL = fmt.Sprintf("/attachments/%d", a.ID)
+	ab.Width, ab.Height = a.Width, a.Height
+	if a.ThumbKey != "" {
+		ab.ThumbnailURL = ab.URL + "/thumbnail"
+	}
+	out, err := json.Marshal(&ab)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(out), a.ID, nil
+}
+
+// linkAttachment records that attachment id was sent in messageID, or
+// returns ErrAttachmentUsed when it was already sent.
+func linkAttachment(tx *gorm.DB, id, messageID uint) error {
+	result := tx.Model(&model.Attachment{}).
+		Where("id = ? AND message_id IS NULL", id).
+		Update("message_id", messageID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAttachmentUsed
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package service
+
+import (
+	"bytes"
+	"chat/global"
+	"chat/imaging"
+	"chat/model"
+	"chat/storage"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AvatarSizes are the square sizes, in pixels, generated for every avatar.
+var AvatarSizes = []int{64, 128, 512}
+
+// DefaultAvatarSize is the size stored as the user's avatar_url.
+const DefaultAvatarSize = 128
+
+// AvatarMaxSize is the largest avatar upload accepted, in bytes.
+const AvatarMaxSize = 10 << 20
+
+// avatarPrefix is the storage key prefix of avatar files. Avatars are only
+// served through GET /avatar/:id, which applies the owner's privacy
+// settings.
+const avatarPrefix = "avatars"
+
+// SaveAvatar decodes an uploaded image, stores it as square avatars in every
+// size of AvatarSizes and makes the DefaultAvatarSize one the avatar of
+// userID. Re-encoding drops any EXIF metadata. Files of the avatar it
+// replaces are removed. It returns the URL of each size.
+func SaveAvatar(userID uint, data []byte) (map[int]string, error) {
+	ct := imaging.Sniff(data)
+	img, err := imaging.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	// a random version keeps keys unguessable and changes the URL, so
+	// caches do not keep showing the replaced avatar
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	version := hex.EncodeToString(b)
+	ctx := context.Background()
+	urls := make(map[int]string, len(AvatarSizes))
+	for _, size := range AvatarSizes {
+		sq := imaging.Square(img, size)
+		// keep transparency for formats that may have it
+		out, outType := []byte(nil), "image/jpeg"
+		if ct == "image/png" || ct == "image/gif" {
+			out, err = imaging.EncodePNG(sq)
+			outType = "image/png"
+		} else {
+			out, err = imaging.EncodeJPEG(sq, 85)
+		}
+		if err == nil {
+			err = global.GVA_STORAGE.Put(ctx, avatarKey(userID, version, size), bytes.NewReader(out), int64(len(out)), outType)
+		}
+		if err != nil {
+			removeAvatarVersion(userID, version)
+			return nil, err
+		}
+		urls[size] = avatarURL(userID, version, size)
+	}
+	var old model.UserBasic
+	err = global.GVA_DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "avatar_url").First(&old, userID).Error; err != nil {
+			return err
+		}
+		return tx.Model(&model.UserBasic{}).Where("id = ?", userID).
+			Update("avatar_url", urls[DefaultAvatarSize]).Error
+	})
+	if err != nil {
+		removeAvatarVersion(userID, version)
+		return nil, err
+	}
+	removeAvatar(userID, old.AvatarURL)
+	return urls, nil
+}
+
+// avatarKey is the storage key of one size of an avatar version. Keys have
+// no extension; the type is sniffed when served.
+func avatarKey(userID uint, version string, size int) string {
+	return fmt.Sprintf("%s/%d_%s_%d", avatarPrefix, userID, version, size)
+}
+
+// avatarURL is the URL of one size of an avatar version; only the default
+// size is stored as avatar_url.
+func avatarURL(userID uint, version string, size int) string {
+	if size == DefaultAvatarSize {
+		return fmt.Sprintf("/avatar/%d?v=%s", userID, version)
+	}
+	return fmt.Sprintf("/avatar/%d?size=%d&v=%s", userID, size, version)
+}
+
+// AvatarTokenTTL is the shortest time an avatar URL signed for a viewer
+// keeps working. Tokens expire at the end of the following period, so a
+// URL stays the same, and cacheable, for a whole period.
+const AvatarTokenTTL = time.Hour
+
+// avatarSignature signs the viewer token of owner's avatar with the JWT
+// secret.
+func avatarSignature(owner, viewer uint, exp int64) string {
+	secret := jwtSecretFromEnv()
+	if secret == "" {
+		secret = "secret"
+	}
+	mac := hmac.New(sha256.New, []byte("avatar:"+secret))
+	fmt.Fprintf(mac, "%d:%d:%d", owner, viewer, exp)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// signAvatarURL adds a token naming viewer to url, an avatar URL of owner.
+// Images load without an Authorization header, so the token is how
+// GET /avatar/:id tells who is looking.
+func signAvatarURL(url string, owner, viewer uint) string {
+	if viewer == 0 || !strings.HasPrefix(url, fmt.Sprintf("/avatar/%d?", owner)) {
+		return url
+	}
+	exp := time.Now().Truncate(AvatarTokenTTL).Add(2 * AvatarTokenTTL).Unix()
+	return fmt.Sprintf("%s&viewer=%d&exp=%d&sig=%s", url, viewer, exp, avatarSignature(owner, viewer, exp))
+}
+
+// AvatarViewer returns the viewer a signed avatar URL of owner names, or 0
+// when its token is missing, expired or forged.
+func AvatarViewer(owner uint, viewer, exp, sig string) uint {
+	v, err := strconv.ParseUint(viewer, 10, 64)
+	if err != nil || v == 0 {
+		return 0
+	}
+	e, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > e {
+		return 0
+	}
+	if !hmac.Equal([]byte(sig), []byte(avatarSignature(owner, uint(v), e))) {
+		return 0
+	}
+	return uint(v)
+}
+
+// ViewerAvatarURL returns url, owner's avatar_url, as viewer may use it:
+// empty when owner's privacy settings hide the avatar from viewer, signed
+// for viewer when they show it to some users only.
+func ViewerAvatarURL(url string, owner, viewer uint) (string, error) {
+	if url == "" {
+		return "", nil
+	}
+	s, err := GetPrivacy(owner)
+	if err != nil {
+		return "", err
+	}
+	visible, err := visibleTo(s.Avatar, owner, viewer)
+	if err != nil || !visible {
+		return "", err
+	}
+	if s.Avatar == model.VisibleEveryone {
+		return url, nil
+	}
+	return signAvatarURL(url, owner, viewer), nil
+}
+
+// avatarVersion returns the version of an avatar_url set by SaveAvatar.
+func avatarVersion(userID uint, url string) (string, bool) {
+	v, ok := strings.CutPrefix(url, fmt.Sprintf("/avatar/%d?v=", userID))
+	if !ok || v == "" || strings.ContainsAny(v, `/\.&`) {
+		return "", false
+	}
+	return v, true
+}
+
+// legacyAvatarPrefix starts avatar_url values of avatars uploaded when they
+// were served statically; their files are stored under avatarPrefix with
+// their original names.
+const legacyAvatarPrefix = "/static/avatars/"
+
+// legacyAvatarKeys returns the storage keys of the size and the default size
+// of a legacy avatar named name.
+func legacyAvatarKeys(name string, size int) []string {
+	name = path.Base(name)
+	sized := strings.Replace(name, fmt.Sprintf("_%d.", DefaultAvatarSize), fmt.Sprintf("_%d.", size), 1)
+	keys := []string{avatarPrefix + "/" + sized}
+	if sized != name {
+		keys = append(keys, avatarPrefix+"/"+name)
+	}
+	return keys
+}
+
+// removeAvatar removes the files of the avatar userID had at url. Failures
+// are logged: the avatar has already been replaced.
+func removeAvatar(userID uint, url string) {
+	if v, ok := avatarVersion(userID, url); ok {
+		removeAvatarVersion(userID, v)
+		return
+	}
+	name, ok := strings.CutPrefix(url, legacyAvatarPrefix)
+	if !ok {
+		return
+	}
+	for _, size := range AvatarSizes {
+		removeObject(legacyAvatarKeys(name, size)[0])
+	}
+}
+
+// removeAvatarVersion removes every size of an avatar version.
+func removeAvatarVersion(userID uint, version string) {
+	for _, size := range AvatarSizes {
+		removeObject(avatarKey(userID, version, size))
+	}
+}
+
+// removeObject deletes key from storage, logging failures.
+func removeObject(key string) {
+	if err := global.GVA_STORAGE.Delete(context.Background(), key); err != nil {
+		log.Printf("delete %s: %v", key, err)
+	}
+}
+
+// Avatar is what GET /avatar/:id serves for a user.
+type Avatar struct {
+	// Keys are the storage keys of an uploaded avatar, the best match
+	// first; the first one stored is served.
+	Keys []string
+	// URL is set instead when the avatar lives elsewhere.
+	URL string
+	// Seed picks the generated identicon served when the user has no
+	// avatar; it is derived from the user's id and name.
+	Seed string
+}
+
+// FindAvatar returns the avatar of userID closest to size, one of
+// AvatarSizes, as seen by viewer (0 when anonymous). Avatars uploaded before
+// sizes were generated only have one file, which is used for every size.
+// Viewers the privacy settings hide the upload from get the identicon.
+func FindAvatar(userID, viewer uint, size int) (*Avatar, error) {
+	var user model.UserBasic
+	if err := global.GVA_DB.Select("id", "name", "avatar_url").First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("user not found")
+		}
+		return nil, err
+	}
+	a := &Avatar{Seed: fmt.Sprintf("%d:%s", user.ID, user.Name)}
+	if user.AvatarURL != "" {
+		visible, err := AvatarVisible(userID, viewer)
+		if err != nil {
+			return nil, err
+		}
+		if !visible {
+			return a, nil
+		}
+	}
+	if v, ok := avatarVersion(userID, user.AvatarURL); ok {
+		a.Keys = []string{avatarKey(userID, v, size)}
+		return a, nil
+	}
+	name, legacy := strings.CutPrefix(user.AvatarURL, legacyAvatarPrefix)
+	switch {
+	case user.AvatarURL == "":
+	case !legacy:
+		a.URL = user.AvatarURL
+	default:
+		a.Keys = legacyAvatarKeys(name, size)
+	}
+	return a, nil
+}
+
+// OpenAvatar opens the first stored file of a.Keys and returns it with its
+// key. It returns storage.ErrNotFound when none is stored.
+func OpenAvatar(a *Avatar) (io.ReadCloser, string, error) {
+	for _, key := range a.Keys {
+		r, err := global.GVA_STORAGE.Get(context.Background(), key)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		return r, key, err
+	}
+	return nil, "", storage.ErrNotFound
+}
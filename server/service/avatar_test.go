@@ -0,0 +1,37 @@
+package service
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignedAvatarURLNamesViewer(t *testing.T) {
+	signed := signAvatarURL("/avatar/7?v=abc", 7, 3)
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("v") != "abc" {
+		t.Fatalf("version lost in %q", signed)
+	}
+	if got := AvatarViewer(7, q.Get("viewer"), q.Get("exp"), q.Get("sig")); got != 3 {
+		t.Fatalf("viewer = %d, want 3", got)
+	}
+	// the token neither names another viewer nor opens another avatar
+	if got := AvatarViewer(7, "4", q.Get("exp"), q.Get("sig")); got != 0 {
+		t.Fatalf("changed viewer accepted as %d", got)
+	}
+	if got := AvatarViewer(8, q.Get("viewer"), q.Get("exp"), q.Get("sig")); got != 0 {
+		t.Fatalf("token of user 7 accepted for user 8 as %d", got)
+	}
+	past := time.Now().Add(-time.Minute).Unix()
+	if got := AvatarViewer(7, "3", strconv.FormatInt(past, 10), avatarSignature(7, 3, past)); got != 0 {
+		t.Fatalf("expired token accepted as %d", got)
+	}
+	if got := signAvatarURL("https://cdn.example.com/a.png", 7, 3); got != "https://cdn.example.com/a.png" {
+		t.Fatalf("external URL signed: %q", got)
+	}
+}
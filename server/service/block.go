@@ -0,0 +1,97 @@
+package service
+
+import (
+	"chat/global"
+	"chat/model"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrBlockSelf  = errors.New("cannot block yourself")
+	ErrNotBlocked = errors.New("user not blocked")
+	// ErrBlocked does not say who blocked whom.
+	ErrBlocked = errors.New("user unavailable")
+)
+
+// BlockedUser is an entry of a user's block list.
+type BlockedUser struct {
+	UserID    uint      `json:"user_id"`
+	Name      string    `json:"name"`
+	BlockedAt time.Time `json:"blocked_at"`
+}
+
+// BlockUser makes uid block target and ends any friendship or request
+// between them. It reports whether the block is new.
+func BlockUser(uid, target uint) (bool, error) {
+	if uid == target {
+		return false, ErrBlockSelf
+	}
+	var user model.UserBasic
+	if err := global.GVA_DB.Select("id").First(&user, target).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, fmt.Errorf("user not found")
+		}
+		return false, err
+	}
+	created := false
+	err := global.GVA_DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.UserBlock{UserID: uid, BlockedID: target})
+		if result.Error != nil {
+			return result.Error
+		}
+		created = result.RowsAffected == 1
+		return tx.Where("pair = ?", model.FriendPair(uid, target)).Delete(&model.Friendship{}).Error
+	})
+	return created, err
+}
+
+// UnblockUser lifts the block uid placed on target.
+func UnblockUser(uid, target uint) error {
+	result := global.GVA_DB.Where("user_id = ? AND blocked_id = ?", uid, target).Delete(&model.UserBlock{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotBlocked
+	}
+	return nil
+}
+
+// ListBlocks returns the users uid blocked, newest first.
+func ListBlocks(uid uint) ([]BlockedUser, error) {
+	var out []BlockedUser
+	err := global.GVA_DB.Model(&model.UserBlock{}).
+		Select("user_blocks.blocked_id AS user_id, user_basic.name AS name, user_blocks.created_at AS blocked_at").
+		Joins("JOIN user_basic ON user_basic.id = user_blocks.blocked_id AND user_basic.deleted_at IS NULL").
+		Where("user_blocks.user_id = ?", uid).Order("user_blocks.id desc").Scan(&out).Error
+	return out, err
+}
+
+// Blocked reports whether a blocked b or b blocked a.
+func Blocked(a, b uint) (bool, error) {
+	if a == b || a == 0 || b == 0 {
+		return false, nil
+	}
+	var n int64
+	err := global.GVA_DB.Model(&model.UserBlock{}).
+		Where("(user_id = ? AND blocked_id = ?) OR (user_id = ? AND blocked_id = ?)", a, b, b, a).Count(&n).Error
+	return n > 0, err
+}
+
+// checkBlocked returns ErrBlocked when a and b blocked each other in either
+// direction.
+func checkBlocked(a, b uint) error {
+	blocked, err := Blocked(a, b)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrBlocked
+	}
+	return nil
+}
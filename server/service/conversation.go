@@ -0,0 +1,156 @@
+package service
+
+import (
+	"chat/global"
+	"chat/model"
+	"strings"
+)
+
+// Longest message preview kept in a conversation summary, in runes.
+const previewLength = 100
+
+func preview(body string) string {
+	r := []rune(body)
+	if len(r) <= previewLength {
+		return body
+	}
+	return string(r[:previewLength]) + "…"
+}
+
+// TouchConversations records m as the latest message in the inbox of every
+// participant and bumps the unread count of everyone but the sender.
+func TouchConversations(m *model.Message) error {
+	base := model.Conversation{
+		LastMessageID: m.ID,
+		LastFrom:      m.From,
+		LastType:      m.Type,
+		LastPreview:   preview(m.Body),
+		LastAt:        m.CreatedAt,
+	}
+	var rows []model.Conversation
+	if m.Room != "" {
+		roomID, err := ParseRoomID(m.Room)
+		if err != nil {
+			return err
+		}
+		members, err := ListRoomMembers(roomID)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			row := base
+			row.OwnerID, row.Room = member.UserID, m.Room
+			if member.UserID != m.From {
+				row.Unread = 1
+			}
+			rows = append(rows, row)
+		}
+	} else if m.To != 0 {
+		sender, recipient := base, base
+		sender.OwnerID, sender.PeerID = m.From, m.To
+		recipient.OwnerID, recipient.PeerID, recipient.Unread = m.To, m.From, 1
+		rows = append(rows, sender)
+		if m.To != m.From {
+			rows = append(rows, recipient)
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	// Only move the summary forward: a message stored late must not replace
+	// a newer one. last_message_id is assigned last because MySQL evaluates
+	// the assignments in order. The row alias needs MySQL 8.0.19 or later.
+	placeholders := make([]string, len(rows))
+	args := make([]interface{}, 0, len(rows)*9)
+	for i, r := range rows {
+		placeholders[i] = "(?, ?, ?, ?, ?, ?, ?, ?, ?)"
+		args = append(args, r.OwnerID, r.PeerID, r.Room, r.LastMessageID, r.LastFrom, r.LastType, r.LastPreview, r.LastAt, r.Unread)
+	}
+	newer := "new.last_message_id > conversations.last_message_id"
+	return global.GVA_DB.Exec("INSERT INTO conversations "+conversationColumns+
+		" VALUES "+strings.Join(placeholders, ", ")+" AS new ON DUPLICATE KEY UPDATE"+
+		" unread = conversations.unread + new.unread,"+
+		" last_from = IF("+newer+", new.last_from, conversations.last_from),"+
+		" last_type = IF("+newer+", new.last_type, conversations.last_type),"+
+		" last_preview = IF("+newer+", new.last_preview, conversations.last_preview),"+
+		" last_at = IF("+newer+", new.last_at, conversations.last_at),"+
+		" last_message_id = GREATEST(new.last_message_id, conversations.last_message_id)",
+		args...).Error
+}
+
+// conversationColumns lists the columns written to conversations, in the
+// order of the values inserted.
+const conversationColumns = "(owner_id, peer_id, room, last_message_id, last_from, last_type, last_preview, last_at, unread)"
+
+// BackfillConversations creates the summaries missing for conversations
+// whose messages were stored before summaries were kept, and returns how
+// many it created. Unread counts start from the owner's read marker.
+// Summaries that exist are left alone, so running it again is harmless.
+func BackfillConversations() (int64, error) {
+	// the preview of the last message, as preview cuts it
+	last := "m.id, m.`from`, m.type, IF(CHAR_LENGTH(m.body) > ?, CONCAT(LEFT(m.body, ?), '…'), m.body), m.created_at"
+	// a summary written meanwhile by TouchConversations wins
+	keep := " ON DUPLICATE KEY UPDATE id = conversations.id"
+	direct := global.GVA_DB.Exec("INSERT INTO conversations "+conversationColumns+
+		" SELECT k.owner_id, k.peer_id, '', "+last+","+
+		" (SELECT COUNT(*) FROM messages u WHERE u.`from` = k.peer_id AND u.`to` = k.owner_id AND u.`from` <> u.`to`"+
+		" AND u.room = '' AND u.deleted_at IS NULL AND u.id > COALESCE((SELECT r.last_read_id FROM read_markers r"+
+		" WHERE r.user_id = k.owner_id AND r.peer_id = k.peer_id AND r.room = ''), 0))"+
+		" FROM (SELECT owner_id, peer_id, MAX(id) AS id FROM ("+
+		" SELECT `from` AS owner_id, `to` AS peer_id, id FROM messages WHERE room = '' AND `to` <> 0 AND deleted_at IS NULL"+
+		" UNION ALL"+
+		" SELECT `to`, `from`, id FROM messages WHERE room = '' AND `to` <> 0 AND `to` <> `from` AND deleted_at IS NULL"+
+		") d GROUP BY owner_id, peer_id) k"+
+		" JOIN messages m ON m.id = k.id"+
+		" WHERE NOT EXISTS (SELECT 1 FROM conversations c WHERE c.owner_id = k.owner_id AND c.peer_id = k.peer_id AND c.room = '')"+
+		keep, previewLength, previewLength)
+	if direct.Error != nil {
+		return 0, direct.Error
+	}
+	rooms := global.GVA_DB.Exec("INSERT INTO conversations "+conversationColumns+
+		" SELECT rm.user_id, 0, k.room, "+last+","+
+		" (SELECT COUNT(*) FROM messages u WHERE u.room = k.room AND u.`from` <> rm.user_id AND u.deleted_at IS NULL"+
+		" AND u.id > COALESCE((SELECT r.last_read_id FROM read_markers r"+
+		" WHERE r.user_id = rm.user_id AND r.peer_id = 0 AND r.room = k.room), 0))"+
+		" FROM (SELECT room, MAX(id) AS id FROM messages WHERE room <> '' AND deleted_at IS NULL GROUP BY room) k"+
+		" JOIN messages m ON m.id = k.id"+
+		" JOIN room_members rm ON CAST(rm.room_id AS CHAR) = k.room"+
+		" WHERE NOT EXISTS (SELECT 1 FROM conversations c WHERE c.owner_id = rm.user_id AND c.peer_id = 0 AND c.room = k.room)"+
+		keep, previewLength, previewLength)
+	return direct.RowsAffected + rooms.RowsAffected, rooms.Error
+}
+
+// ListConversations returns up to limit of ownerID's conversations, most
+// recently active first, and the cursor of the next page, zero on the last
+// one. before, when non-zero, continues after the conversation whose last
+// message id was before.
+func ListConversations(ownerID uint, before uint, limit int) ([]model.Conversation, uint, error) {
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	var convs []model.Conversation
+	db := global.GVA_DB.Where("owner_id = ?", ownerID)
+	if before != 0 {
+		db = db.Where("last_message_id < ?", before)
+	}
+	if err := db.Order("last_message_id desc").Limit(limit + 1).Find(&convs).Error; err != nil {
+		return nil, 0, err
+	}
+	var next uint
+	if len(convs) > limit {
+		convs = convs[:limit]
+		next = convs[limit-1].LastMessageID
+	}
+	return convs, next, nil
+}
+
+// MarkConversationRead clears the unread count of ownerID's conversation with
+// peerID or in room.
+func MarkConversationRead(ownerID, peerID uint, room string) error {
+	return global.GVA_DB.Model(&model.Conversation{}).
+		Where("owner_id = ? AND peer_id = ? AND room = ?", ownerID, peerID, room).
+		Update("unread", 0).Error
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"chat/global"
+	"chat/model"
+	"context"
+	"strings"
+)
+
+// DirectoryQuery filters the user directory. Name matches names starting
+// with it; Email and Phone match exactly. Empty fields do not filter.
+type DirectoryQuery struct {
+	Name  string
+	Email string
+	Phone string
+}
+
+// DirectoryUser is the public profile of a user as listed in the directory.
+type DirectoryUser struct {
+	ID        uint     `json:"id"`
+	Name      string   `json:"name"`
+	AvatarURL string   `json:"avatar_url"`
+	Presence  Presence `json:"presence"`
+}
+
+// likeEscaper escapes the LIKE wildcards of a user supplied prefix.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchUsers returns a page of the users viewer may see, newest first,
+// and the before cursor of the next page, 0 on the last one. Users blocked
+// either way and suspended accounts are left out, as are users found by
+// email or phone whose privacy settings keep viewer from looking them up
+// that way. Avatars and last-seen times follow the users' privacy settings.
+func SearchUsers(viewer uint, query DirectoryQuery, before uint, limit int) ([]DirectoryUser, uint, error) {
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	q := global.GVA_DB.Model(&model.UserBasic{}).
+		Select("id", "name", "avatar_url", "heartbeat_time", "logout_time").
+		Where("suspended_at IS NULL").
+		Where("id NOT IN (?)", global.GVA_DB.Model(&model.UserBlock{}).Select("blocked_id").Where("user_id = ?", viewer)).
+		Where("id NOT IN (?)", global.GVA_DB.Model(&model.UserBlock{}).Select("user_id").Where("blocked_id = ?", viewer))
+	if query.Name != "" {
+		q = q.Where("name LIKE ?", likeEscaper.Replace(query.Name)+"%")
+	}
+	if query.Email != "" {
+		q = q.Where("email = ?", query.Email)
+	}
+	if query.Phone != "" {
+		q = q.Where("phone = ?", query.Phone)
+	}
+	if before > 0 {
+		q = q.Where("id < ?", before)
+	}
+	var users []model.UserBasic
+	if err := q.Order("id desc").Limit(limit + 1).Find(&users).Error; err != nil {
+		return nil, 0, err
+	}
+	var next uint
+	if len(users) > limit {
+		users = users[:limit]
+		// the cursor comes from the page read, as users hidden below would
+		// otherwise be read again
+		next = users[limit-1].ID
+	}
+	ids := make([]uint, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+	privacy, err := privacyOf(ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	friends, err := friendsAmong(viewer, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	// blocked users are already filtered out, which leaves the audience
+	// check of visibleTo without queries
+	visible := func(audience string, owner uint) bool {
+		return owner == viewer || audience == model.VisibleEveryone ||
+			audience == model.VisibleContacts && friends[owner]
+	}
+	statuses := map[uint]string{}
+	if global.GVA_REDIS != nil {
+		if statuses, err = presenceStatuses(context.Background(), ids); err != nil {
+			return nil, 0, err
+		}
+	}
+	lookup := query.Email != "" || query.Phone != ""
+	out := make([]DirectoryUser, 0, len(users))
+	for i := range users {
+		u := &users[i]
+		s := privacy[u.ID]
+		if lookup && !visible(s.ContactLookup, u.ID) {
+			continue
+		}
+		d := DirectoryUser{ID: u.ID, Name: u.Name, Presence: Presence{UserID: u.ID, Status: PresenceOffline}}
+		if visible(s.Avatar, u.ID) {
+			d.AvatarURL = u.AvatarURL
+			if s.Avatar != model.VisibleEveryone {
+				d.AvatarURL = signAvatarURL(u.AvatarURL, u.ID, viewer)
+			}
+		}
+		if status, ok := statuses[u.ID]; ok {
+			d.Presence.Status = status
+		}
+		if d.Presence.Status != PresenceOnline && visible(s.LastSeen, u.ID) {
+			d.Presence.LastSeen = lastSeen(u)
+		}
+		out = append(out, d)
+	}
+	return out, next, nil
+}
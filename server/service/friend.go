@@ -0,0 +1,246 @@
+package service
+
+import (
+	"chat/global"
+	"chat/model"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrFriendSelf            = errors.New("cannot befriend yourself")
+	ErrFriendRequestNotFound = errors.New("friend request not found")
+	ErrNotFriends            = errors.New("not a contact")
+)
+
+// ContactsOnlyDirectMessages limits direct messages to accepted contacts.
+var ContactsOnlyDirectMessages = false
+
+// Contact is a friendship as seen by one of its users.
+type Contact struct {
+	UserID    uint   `json:"user_id"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url"`
+	Status    string `json:"status"`
+	// Direction is "incoming" or "outgoing" while the request is pending.
+	Direction string    `json:"direction,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// RequestFriend asks target to become a contact of uid. It returns the
+// friendship and whether it changed: asking again while pending changes
+// nothing, and asking someone who already asked uid accepts their request.
+func RequestFriend(uid, target uint) (*model.Friendship, bool, error) {
+	if uid == target {
+		return nil, false, ErrFriendSelf
+	}
+	var user model.UserBasic
+	if err := global.GVA_DB.Select("id").First(&user, target).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, fmt.Errorf("user not found")
+		}
+		return nil, false, err
+	}
+	if err := checkBlocked(uid, target); err != nil {
+		return nil, false, err
+	}
+	var f model.Friendship
+	changed := false
+	err := global.GVA_DB.Transaction(func(tx *gorm.DB) error {
+		f = model.Friendship{RequesterID: uid, AddresseeID: target, Pair: model.FriendPair(uid, target), Status: model.FriendshipPending}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&f)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			changed = true
+			return nil
+		}
+		f = model.Friendship{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("pair = ?", model.FriendPair(uid, target)).First(&f).Error; err != nil {
+			return err
+		}
+		if f.Status != model.FriendshipPending || f.RequesterID != target {
+			return nil
+		}
+		// both asked: the second request accepts the first
+		changed = true
+		return accept(tx, &f)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &f, changed, nil
+}
+
+// AcceptFriend accepts the pending request requester sent to uid.
+func AcceptFriend(uid, requester uint) (*model.Friendship, error) {
+	var f model.Friendship
+	err := global.GVA_DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("requester_id = ? AND addressee_id = ? AND status = ?", requester, uid, model.FriendshipPending).
+			First(&f).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrFriendRequestNotFound
+			}
+			return err
+		}
+		return accept(tx, &f)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func accept(tx *gorm.DB, f *model.Friendship) error {
+	now := time.Now()
+	f.Status, f.AcceptedAt = model.FriendshipAccepted, &now
+	return tx.Model(f).Updates(map[string]interface{}{"status": f.Status, "accepted_at": now}).Error
+}
+
+// DeclineFriend drops the pending request requester sent to uid.
+func DeclineFriend(uid, requester uint) error {
+	result := global.GVA_DB.Where("requester_id = ? AND addressee_id = ? AND status = ?", requester, uid, model.FriendshipPending).
+		Delete(&model.Friendship{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrFriendRequestNotFound
+	}
+	return nil
+}
+
+// RemoveFriend ends the friendship between uid and other, or withdraws a
+// request uid sent to other.
+func RemoveFriend(uid, other uint) error {
+	result := global.GVA_DB.Where("pair = ? AND (status = ? OR requester_id = ?)", model.FriendPair(uid, other), model.FriendshipAccepted, uid).
+		Delete(&model.Friendship{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFriends
+	}
+	return nil
+}
+
+// AreFriends reports whether a and b are accepted contacts.
+func AreFriends(a, b uint) (bool, error) {
+	var n int64
+	err := global.GVA_DB.Model(&model.Friendship{}).
+		Where("pair = ? AND status = ?", model.FriendPair(a, b), model.FriendshipAccepted).Count(&n).Error
+	return n > 0, err
+}
+
+// friendsAmong returns which of uids are accepted contacts of uid.
+func friendsAmong(uid uint, uids []uint) (map[uint]bool, error) {
+	out := make(map[uint]bool)
+	if len(uids) == 0 {
+		return out, nil
+	}
+	pairs := make([]string, len(uids))
+	for i, id := range uids {
+		pairs[i] = model.FriendPair(uid, id)
+	}
+	var rows []model.Friendship
+	err := global.GVA_DB.Select("requester_id", "addressee_id").
+		Where("pair IN ? AND status = ?", pairs, model.FriendshipAccepted).Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range rows {
+		out[f.RequesterID+f.AddresseeID-uid] = true
+	}
+	return out, nil
+}
+
+// CheckDirectMessage returns ErrBlocked when from and to blocked each other,
+// and ErrNotFriends when direct messages are limited to contacts and to is
+// not one of from's. Notes to self are always allowed.
+func CheckDirectMessage(from, to uint) error {
+	if from == to {
+		return nil
+	}
+	if err := checkBlocked(from, to); err != nil {
+		return err
+	}
+	if !ContactsOnlyDirectMessages {
+		return nil
+	}
+	ok, err := AreFriends(from, to)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotFriends
+	}
+	return nil
+}
+
+// ListContacts returns the friendships of uid, newest first. filter is
+// "accepted", "incoming", "outgoing" or "" for all of them.
+func ListContacts(uid uint, filter string) ([]Contact, error) {
+	q := global.GVA_DB.Model(&model.Friendship{})
+	switch filter {
+	case "":
+		q = q.Where("requester_id = ? OR addressee_id = ?", uid, uid)
+	case "accepted":
+		q = q.Where("(requester_id = ? OR addressee_id = ?) AND status = ?", uid, uid, model.FriendshipAccepted)
+	case "incoming":
+		q = q.Where("addressee_id = ? AND status = ?", uid, model.FriendshipPending)
+	case "outgoing":
+		q = q.Where("requester_id = ? AND status = ?", uid, model.FriendshipPending)
+	default:
+		return nil, fmt.Errorf("invalid filter %q", filter)
+	}
+	var rows []model.Friendship
+	if err := q.Order("id desc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	ids := make([]uint, len(rows))
+	for i, f := range rows {
+		ids[i] = f.RequesterID + f.AddresseeID - uid
+	}
+	var users []model.UserBasic
+	if len(ids) > 0 {
+		if err := global.GVA_DB.Select("id", "name", "avatar_url").Where("id IN ?", ids).Find(&users).Error; err != nil {
+			return nil, err
+		}
+	}
+	byID := make(map[uint]model.UserBasic, len(users))
+	for _, u := range users {
+		byID[u.ID] = u
+	}
+	contacts := make([]Contact, 0, len(rows))
+	for i, f := range rows {
+		u, ok := byID[ids[i]]
+		if !ok {
+			// the other user was deleted
+			continue
+		}
+		c := Contact{UserID: u.ID, Name: u.Name, Status: f.Status, Since: f.CreatedAt}
+		avatar, err := ViewerAvatarURL(u.AvatarURL, u.ID, uid)
+		if err != nil {
+			return nil, err
+		}
+		c.AvatarURL = avatar
+		switch {
+		case f.Status == model.FriendshipAccepted:
+			if f.AcceptedAt != nil {
+				c.Since = *f.AcceptedAt
+			}
+		case f.RequesterID == uid:
+			c.Direction = "outgoing"
+		default:
+			c.Direction = "incoming"
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, nil
+}
@@ -3,16 +3,110 @@ package service
 import (
 	"chat/global"
 	"chat/model"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-// SaveMessage persists a message and returns any error.
+// ErrDuplicateMessage is returned by SaveMessage when the sender already
+// stored a message with the same client message id.
+var ErrDuplicateMessage = errors.New("duplicate message")
+
+// ErrInvalidReply is returned by SaveMessage when ReplyTo names a message
+// outside the conversation of the reply.
+var ErrInvalidReply = errors.New("invalid reply_to")
+
+// SaveMessage persists a message and returns any error. When m carries a
+// ClientMsgID that the sender already used, nothing is inserted, m is filled
+// with the stored message and ErrDuplicateMessage is returned. A reply gets
+// its ThreadRoot set and bumps the reply count of the root.
 func SaveMessage(m *model.Message) error {
+	return SaveAttachmentMessage(m, 0)
+}
+
+// FindClientMessage returns the message from already stored under
+// clientMsgID, or nil if there is none.
+func FindClientMessage(from uint, clientMsgID string) (*model.Message, error) {
+	var m model.Message
+	err := global.GVA_DB.Where("`from` = ? AND client_msg_id = ?", from, clientMsgID).Limit(1).Find(&m).Error
+	if err != nil || m.ID == 0 {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SaveAttachmentMessage is SaveMessage for a message that sends attachment
+// attachmentID, which is linked to the message in the same transaction. It
+// returns ErrAttachmentUsed when the attachment was sent in the meantime.
+func SaveAttachmentMessage(m *model.Message, attachmentID uint) error {
 	if m == nil {
 		return fmt.Errorf("nil message")
 	}
-	return global.GVA_DB.Create(m).Error
+	if m.ReplyTo != 0 {
+		if err := resolveReply(m); err != nil {
+			return err
+		}
+	}
+	err := global.GVA_DB.Transaction(func(tx *gorm.DB) error {
+		create := tx
+		if m.ClientMsgID != nil {
+			create = tx.Clauses(clause.OnConflict{DoNothing: true})
+		}
+		result := create.Create(m)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrDuplicateMessage
+		}
+		if attachmentID != 0 {
+			if err := linkAttachment(tx, attachmentID, m.ID); err != nil {
+				return err
+			}
+		}
+		if m.ThreadRoot == 0 {
+			return nil
+		}
+		return tx.Model(&model.Message{}).Where("id = ?", m.ThreadRoot).
+			Updates(map[string]interface{}{"reply_count": gorm.Expr("reply_count + 1"), "last_reply_at": m.CreatedAt}).Error
+	})
+	if !errors.Is(err, ErrDuplicateMessage) {
+		return err
+	}
+	var existing model.Message
+	if err := global.GVA_DB.Where("`from` = ? AND client_msg_id = ?", m.From, *m.ClientMsgID).First(&existing).Error; err != nil {
+		return err
+	}
+	*m = existing
+	return ErrDuplicateMessage
+}
+
+// resolveReply checks that the parent of reply m belongs to the same
+// conversation and sets m.ThreadRoot to the root of the parent's thread.
+func resolveReply(m *model.Message) error {
+	var parent model.Message
+	if err := global.GVA_DB.First(&parent, m.ReplyTo).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidReply
+		}
+		return err
+	}
+	same := parent.Room == m.Room
+	if m.Room == "" {
+		same = same && ((parent.From == m.From && parent.To == m.To) || (parent.From == m.To && parent.To == m.From))
+	}
+	if !same || parent.Tombstone {
+		return ErrInvalidReply
+	}
+	m.ThreadRoot = parent.ThreadRoot
+	if m.ThreadRoot == 0 {
+		m.ThreadRoot = parent.ID
+	}
+	return nil
 }
 
 // AckMessage marks a message as delivered/acked by id.
@@ -25,13 +119,314 @@ func AckMessage(messageID uint) error {
 	return result.Error
 }
 
-// GetMessagesBetween returns recent messages between two users (bidirectional).
-func GetMessagesBetween(userA, userB uint, limit int) ([]model.Message, error) {
+// AckMessageFor marks a message addressed to userID as delivered. It returns
+// the message when this call changed it, or nil when the message was already
+// delivered or is not addressed to userID.
+func AckMessageFor(messageID, userID uint) (*model.Message, error) {
+	now := time.Now()
+	result := global.GVA_DB.Model(&model.Message{}).
+		Where("id = ? AND `to` = ? AND delivered = ?", messageID, userID, false).
+		Updates(map[string]interface{}{
+			"delivered":    true,
+			"delivered_at": &now,
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+	var m model.Message
+	if err := global.GVA_DB.First(&m, messageID).Error; err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// GetUndeliveredMessages returns up to limit direct messages addressed to
+// userID that have not been delivered yet, oldest first, starting after
+// afterID.
+func GetUndeliveredMessages(userID, afterID uint, limit int) ([]model.Message, error) {
 	var msgs []model.Message
 	if limit <= 0 {
 		limit = 100
 	}
-	err := global.GVA_DB.Where("(\"from\" = ? AND \"to\" = ?) OR (\"from\" = ? AND \"to\" = ?)", userA, userB, userB, userA).
+	err := global.GVA_DB.Where("`to` = ? AND delivered = ? AND tombstone = ? AND id > ?", userID, false, false, afterID).
 		Order("id asc").Limit(limit).Find(&msgs).Error
 	return msgs, err
 }
+
+// GetMessagesByIDs returns the messages with the given ids in id order.
+func GetMessagesByIDs(ids []uint) ([]model.Message, error) {
+	var msgs []model.Message
+	if len(ids) == 0 {
+		return msgs, nil
+	}
+	err := global.GVA_DB.Where("id IN ?", ids).Order("id asc").Find(&msgs).Error
+	return msgs, err
+}
+
+var (
+	ErrMessageNotFound  = errors.New("message not found")
+	ErrNotMessageSender = errors.New("only the sender may change a message")
+	ErrMessageDeleted   = errors.New("message deleted")
+	ErrNotEditable      = errors.New("attachment messages cannot be edited")
+)
+
+// changeMessage loads messageID for update, checks userID sent it, unless
+// anyone is set, and is still allowed to change it, and applies fn inside
+// the same transaction.
+func changeMessage(userID, messageID uint, anyone bool, fn func(tx *gorm.DB, m *model.Message) error) (*model.Message, error) {
+	var m model.Message
+	err := global.GVA_DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&m, messageID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrMessageNotFound
+			}
+			return err
+		}
+		if m.From != userID && !anyone {
+			return ErrNotMessageSender
+		}
+		if m.Tombstone {
+			return ErrMessageDeleted
+		}
+		return fn(tx, &m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// EditMessage replaces the body of a message sent by userID, keeping the
+// previous body as a revision.
+func EditMessage(userID, messageID uint, body string) (*model.Message, error) {
+	if body == "" {
+		return nil, fmt.Errorf("body required")
+	}
+	return changeMessage(userID, messageID, false, func(tx *gorm.DB, m *model.Message) error {
+		if err := checkEditable(m); err != nil {
+			return err
+		}
+		if err := tx.Create(&model.MessageRevision{MessageID: m.ID, Body: m.Body}).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		m.Body, m.EditedAt = body, &now
+		if err := tx.Model(m).Updates(map[string]interface{}{"body": body, "edited_at": now}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&model.Conversation{}).Where("last_message_id = ?", m.ID).
+			Update("last_preview", preview(body)).Error
+	})
+}
+
+// checkEditable rejects edits of messages whose body the server built, such
+// as an attachment's, which a new body could point at another file.
+func checkEditable(m *model.Message) error {
+	if m.Type == "attachment" {
+		return ErrNotEditable
+	}
+	return nil
+}
+
+// DeleteMessage turns a message sent by userID, or any message when userID
+// holds message.delete_any, into a tombstone and drops its revisions and
+// reactions. A deleted reply no longer counts towards its thread.
+func DeleteMessage(userID, messageID uint) (*model.Message, error) {
+	anyone, err := HasPermission(userID, model.PermMessageDeleteAny)
+	if err != nil {
+		return nil, err
+	}
+	return changeMessage(userID, messageID, anyone, func(tx *gorm.DB, m *model.Message) error {
+		if err := tx.Where("message_id = ?", m.ID).Delete(&model.MessageRevision{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id = ?", m.ID).Delete(&model.MessageReaction{}).Error; err != nil {
+			return err
+		}
+		m.Body, m.Tombstone = "", true
+		if err := tx.Model(m).Updates(map[string]interface{}{"body": "", "tombstone": true}).Error; err != nil {
+			return err
+		}
+		if m.ThreadRoot != 0 {
+			if err := dropReply(tx, m); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&model.Conversation{}).Where("last_message_id = ?", m.ID).
+			Update("last_preview", "").Error
+	})
+}
+
+// dropReply takes the deleted reply m off its thread root's reply count and
+// moves last_reply_at back to the latest reply left, or clears it.
+func dropReply(tx *gorm.DB, m *model.Message) error {
+	var latest model.Message
+	var lastReplyAt interface{}
+	err := tx.Select("created_at").Where("thread_root = ? AND tombstone = ?", m.ThreadRoot, false).
+		Order("id desc").First(&latest).Error
+	switch {
+	case err == nil:
+		lastReplyAt = latest.CreatedAt
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return err
+	}
+	return tx.Model(&model.Message{}).Where("id = ? AND reply_count > 0", m.ThreadRoot).
+		Updates(map[string]interface{}{"reply_count": gorm.Expr("reply_count - 1"), "last_reply_at": lastReplyAt}).Error
+}
+
+// Page size bounds for message history.
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// MessageCursor selects a page of history by message id. With Before set the
+// page holds the newest messages older than Before; with After set it holds
+// the oldest messages newer than After; with Around set it holds Around and
+// the messages on both sides of it; with none it holds the newest messages.
+type MessageCursor struct {
+	Before uint
+	After  uint
+	Around uint
+	Limit  int
+}
+
+// MessagePage is a page of history in ascending id order. HasMore reports
+// whether further messages exist in the paging direction; for an Around
+// page HasOlder and HasNewer report each side.
+type MessagePage struct {
+	Messages []model.Message
+	HasMore  bool
+	HasOlder bool
+	HasNewer bool
+}
+
+// pageMessages applies cur to a query already scoped to one conversation.
+func pageMessages(db *gorm.DB, cur MessageCursor) (*MessagePage, error) {
+	db = db.Session(&gorm.Session{})
+	limit := cur.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	page := &MessagePage{}
+	switch {
+	case cur.Around != 0:
+		// older half strictly before the anchor, the rest from the anchor on
+		older, hasOlder, err := newestBefore(db, cur.Around, limit/2)
+		if err != nil {
+			return nil, err
+		}
+		newer, hasNewer, err := oldestFrom(db, cur.Around, limit-len(older))
+		if err != nil {
+			return nil, err
+		}
+		page.Messages = append(older, newer...)
+		page.HasOlder, page.HasNewer = hasOlder, hasNewer
+		page.HasMore = hasOlder || hasNewer
+	case cur.After != 0:
+		msgs, more, err := oldestFrom(db, cur.After+1, limit)
+		if err != nil {
+			return nil, err
+		}
+		page.Messages, page.HasMore, page.HasNewer = msgs, more, more
+	default:
+		msgs, more, err := newestBefore(db, cur.Before, limit)
+		if err != nil {
+			return nil, err
+		}
+		page.Messages, page.HasMore, page.HasOlder = msgs, more, more
+	}
+	if err := attachReactions(page.Messages); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// newestBefore returns up to limit messages with id < before (any id when
+// before is 0) in ascending order, and whether older ones remain.
+func newestBefore(db *gorm.DB, before uint, limit int) ([]model.Message, bool, error) {
+	var msgs []model.Message
+	if limit <= 0 {
+		return msgs, false, nil
+	}
+	q := db
+	if before != 0 {
+		q = q.Where("id < ?", before)
+	}
+	if err := q.Order("id desc").Limit(limit + 1).Find(&msgs).Error; err != nil {
+		return nil, false, err
+	}
+	more := len(msgs) > limit
+	if more {
+		msgs = msgs[:limit]
+	}
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, more, nil
+}
+
+// oldestFrom returns up to limit messages with id >= from in ascending
+// order, and whether newer ones remain.
+func oldestFrom(db *gorm.DB, from uint, limit int) ([]model.Message, bool, error) {
+	var msgs []model.Message
+	if limit <= 0 {
+		return msgs, false, nil
+	}
+	if err := db.Where("id >= ?", from).Order("id asc").Limit(limit + 1).Find(&msgs).Error; err != nil {
+		return nil, false, err
+	}
+	more := len(msgs) > limit
+	if more {
+		msgs = msgs[:limit]
+	}
+	return msgs, more, nil
+}
+
+// GetRoomMessages returns a page of messages posted in roomID.
+func GetRoomMessages(roomID uint, cur MessageCursor) (*MessagePage, error) {
+	db := global.GVA_DB.Model(&model.Message{}).Where("room = ?", strconv.FormatUint(uint64(roomID), 10))
+	return pageMessages(db, cur)
+}
+
+// GetMessagesBetween returns a page of the direct conversation between two
+// users.
+func GetMessagesBetween(userA, userB uint, cur MessageCursor) (*MessagePage, error) {
+	db := global.GVA_DB.Model(&model.Message{}).
+		Where("((`from` = ? AND `to` = ?) OR (`from` = ? AND `to` = ?)) AND room = ?", userA, userB, userB, userA, "")
+	return pageMessages(db, cur)
+}
+
+// GetThread returns the root of the thread messageID belongs to and a page of
+// its replies. userID must take part in the conversation.
+func GetThread(userID, messageID uint, cur MessageCursor) (*model.Message, *MessagePage, error) {
+	var m model.Message
+	if err := global.GVA_DB.First(&m, messageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrMessageNotFound
+		}
+		return nil, nil, err
+	}
+	if _, _, err := conversationOf(&m, userID); err != nil {
+		return nil, nil, err
+	}
+	root := &m
+	if m.ThreadRoot != 0 {
+		root = &model.Message{}
+		if err := global.GVA_DB.First(root, m.ThreadRoot).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	roots := []model.Message{*root}
+	if err := attachReactions(roots); err != nil {
+		return nil, nil, err
+	}
+	page, err := pageMessages(global.GVA_DB.Model(&model.Message{}).Where("thread_root = ?", root.ID), cur)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &roots[0], page, nil
+}
@@ -0,0 +1,17 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"chat/model"
+)
+
+func TestCheckEditableRejectsAttachments(t *testing.T) {
+	if err := checkEditable(&model.Message{Type: "attachment", Body: `{"attachment_id":1}`}); !errors.Is(err, ErrNotEditable) {
+		t.Fatalf("editing an attachment message: err = %v, want ErrNotEditable", err)
+	}
+	if err := checkEditable(&model.Message{Type: "message", Body: "hello"}); err != nil {
+		t.Fatalf("editing a text message: err = %v", err)
+	}
+}
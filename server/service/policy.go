@@ -0,0 +1,119 @@
+package service
+
+import (
+	"chat/global"
+	"chat/model"
+	"errors"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// ErrForbidden is returned when a user may not act on another account.
+var ErrForbidden = errors.New("forbidden")
+
+// IsAdmin reports whether uid is an administrator: they have the admin
+// Identity or the admin role. Both are read from the database on every call
+// so revoking them takes effect at once.
+func IsAdmin(uid uint) (bool, error) {
+	var user model.UserBasic
+	if err := global.GVA_DB.Select("id", "identity").First(&user, uid).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if user.IsAdmin() {
+		return true, nil
+	}
+	var n int64
+	err := global.GVA_DB.Model(&model.UserRole{}).
+		Joins("JOIN roles ON roles.id = user_roles.role_id").
+		Where("user_roles.user_id = ? AND roles.name = ?", uid, model.RoleAdmin).Count(&n).Error
+	return n > 0, err
+}
+
+// CanManageUser returns nil when actor may change, delete, suspend or log out
+// target's account, and ErrForbidden otherwise. Everyone manages their own
+// account; other accounts need user.manage and that actor outranks target.
+func CanManageUser(actor, target uint) error {
+	if actor == target {
+		return nil
+	}
+	if err := RequirePermission(actor, model.PermUserManage); err != nil {
+		return err
+	}
+	return outranks(actor, target)
+}
+
+// outranks returns ErrForbidden unless actor holds every permission target
+// holds. Only administrators act on administrators.
+func outranks(actor, target uint) error {
+	admin, err := IsAdmin(target)
+	if err != nil {
+		return err
+	}
+	if admin {
+		return CanSetIdentity(actor)
+	}
+	if admin, err = IsAdmin(actor); err != nil || admin {
+		return err
+	}
+	var n int64
+	// permissions of target that actor lacks
+	err = global.GVA_DB.Model(&model.UserRole{}).
+		Joins("JOIN role_permissions ON role_permissions.role_id = user_roles.role_id").
+		Where("user_roles.user_id = ?", target).
+		Where("role_permissions.permission_id NOT IN (?)", global.GVA_DB.Model(&model.UserRole{}).
+			Select("role_permissions.permission_id").
+			Joins("JOIN role_permissions ON role_permissions.role_id = user_roles.role_id").
+			Where("user_roles.user_id = ?", actor)).
+		Count(&n).Error
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// RequirePermission returns ErrForbidden unless uid holds perm.
+func RequirePermission(uid uint, perm string) error {
+	ok, err := HasPermission(uid, perm)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// CanSetIdentity returns ErrForbidden unless actor is an administrator. Only
+// administrators change Identity, including on their own account.
+func CanSetIdentity(actor uint) error {
+	admin, err := IsAdmin(actor)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// Audit records an audit entry. Failures are logged rather than returned so
+// auditing never changes the outcome of the request.
+func Audit(actor uint, action string, target uint, outcome, detail, ip string) {
+	entry := &model.AuditLog{ActorID: actor, Action: action, TargetID: target, Outcome: outcome, Detail: detail, IP: ip}
+	if err := global.GVA_DB.Create(entry).Error; err != nil {
+		log.Printf("audit %s by %d on %d (%s): %v", action, actor, target, outcome, err)
+	}
+}
+
+// AuditDenied records a denied attempt by actor to perform action on target.
+func AuditDenied(actor uint, action string, target uint, reason, ip string) {
+	Audit(actor, action, target, model.AuditDenied, reason, ip)
+	log.Printf("denied %s by user %d on %d: %s", action, actor, target, reason)
+}
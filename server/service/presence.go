@@ -0,0 +1,291 @@
+package service
+
+import (
+	"chat/global"
+	"chat/model"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+// ErrWatchForbidden is returned when a user asks to watch the presence of
+// someone who is neither a contact nor in a shared room.
+var ErrWatchForbidden = errors.New("can only watch contacts and room members")
+
+// Presence statuses. A user is online while any connection is active, away
+// while all connections are marked away and offline otherwise.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// PresenceTTL is how long a connection counts as present without a
+// heartbeat. Clients are pinged well within this window.
+const PresenceTTL = 90 * time.Second
+
+// Presence is the public status of a user.
+type Presence struct {
+	UserID   uint       `json:"user_id"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// Presence lives in a Redis hash per user, one field per connection on any
+// instance, valued "<expiry unix>|<away 0 or 1>". Entries carry their own
+// expiry so connections of an instance that died stop counting on their own.
+func presenceKey(userID uint) string { return fmt.Sprintf("presence:%d", userID) }
+
+func presenceEntry(away bool) string {
+	flag := "0"
+	if away {
+		flag = "1"
+	}
+	return strconv.FormatInt(time.Now().Add(PresenceTTL).Unix(), 10) + "|" + flag
+}
+
+func parsePresenceEntry(v string) (expiry int64, away bool, ok bool) {
+	exp, flag, found := strings.Cut(v, "|")
+	if !found {
+		return 0, false, false
+	}
+	expiry, err := strconv.ParseInt(exp, 10, 64)
+	return expiry, flag == "1", err == nil
+}
+
+// presenceStatus derives userID's status from its connection entries,
+// dropping the expired ones.
+func presenceStatus(ctx context.Context, userID uint) (string, error) {
+	key := presenceKey(userID)
+	vals, err := global.GVA_REDIS.HGetAll(ctx, key).Result()
+	if err != nil {
+		return PresenceOffline, err
+	}
+	status, expired := statusOf(vals)
+	if len(expired) > 0 {
+		global.GVA_REDIS.HDel(ctx, key, expired...)
+	}
+	return status, nil
+}
+
+// presenceStatuses is presenceStatus for several users in one round trip.
+// Expired entries are left for the next single lookup to drop.
+func presenceStatuses(ctx context.Context, userIDs []uint) (map[uint]string, error) {
+	out := make(map[uint]string, len(userIDs))
+	if len(userIDs) == 0 {
+		return out, nil
+	}
+	pipe := global.GVA_REDIS.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(userIDs))
+	for i, id := range userIDs {
+		cmds[i] = pipe.HGetAll(ctx, presenceKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for i, id := range userIDs {
+		out[id], _ = statusOf(cmds[i].Val())
+	}
+	return out, nil
+}
+
+// statusOf derives a status from the connection entries of a user and
+// returns the expired connections.
+func statusOf(vals map[string]string) (string, []string) {
+	now := time.Now().Unix()
+	status := PresenceOffline
+	var expired []string
+	for conn, v := range vals {
+		expiry, away, ok := parsePresenceEntry(v)
+		if !ok || expiry < now {
+			expired = append(expired, conn)
+			continue
+		}
+		if !away {
+			status = PresenceOnline
+		} else if status == PresenceOffline {
+			status = PresenceAway
+		}
+	}
+	return status, expired
+}
+
+// updatePresence writes (or, when remove is set, deletes) the entry of one
+// connection and returns the user's status afterwards and whether it changed.
+func updatePresence(userID uint, conn string, away, remove bool) (string, bool, error) {
+	if global.GVA_REDIS == nil {
+		return PresenceOffline, false, nil
+	}
+	ctx := context.Background()
+	key := presenceKey(userID)
+	before, err := presenceStatus(ctx, userID)
+	if err != nil {
+		return before, false, err
+	}
+	if remove {
+		err = global.GVA_REDIS.HDel(ctx, key, conn).Err()
+	} else {
+		pipe := global.GVA_REDIS.TxPipeline()
+		pipe.HSet(ctx, key, conn, presenceEntry(away))
+		pipe.Expire(ctx, key, PresenceTTL)
+		_, err = pipe.Exec(ctx)
+	}
+	if err != nil {
+		return before, false, err
+	}
+	after, err := presenceStatus(ctx, userID)
+	if err != nil {
+		return after, false, err
+	}
+	now := uint64(time.Now().Unix())
+	switch {
+	case before == PresenceOffline && after != PresenceOffline:
+		global.GVA_DB.Model(&model.UserBasic{}).Where("id = ?", userID).
+			Updates(map[string]interface{}{"login_time": now, "heartbeat_time": now, "is_logout": false})
+	case before != PresenceOffline && after == PresenceOffline:
+		global.GVA_DB.Model(&model.UserBasic{}).Where("id = ?", userID).
+			Updates(map[string]interface{}{"logout_time": now, "is_logout": true})
+	}
+	return after, before != after, nil
+}
+
+// ConnectPresence records a new active connection of userID.
+func ConnectPresence(userID uint, conn string) (string, bool, error) {
+	return updatePresence(userID, conn, false, false)
+}
+
+// SetPresenceAway marks one connection of userID as away or active again.
+func SetPresenceAway(userID uint, conn string, away bool) (string, bool, error) {
+	return updatePresence(userID, conn, away, false)
+}
+
+// HeartbeatInterval is how often a connection's heartbeat time is written
+// to the database. It only matters for the last-seen time of connections
+// lost without a disconnect, which is that much coarser.
+const HeartbeatInterval = 5 * time.Minute
+
+// heartbeats maps the local connections to when they last wrote the
+// heartbeat time.
+var heartbeats sync.Map
+
+// RefreshPresence extends the entry of a connection on heartbeat, keeping
+// its away flag, and records the heartbeat time every HeartbeatInterval.
+// A live entry is extended without recomputing the status, which cannot
+// change; only a lapsed one goes through the full update.
+func RefreshPresence(userID uint, conn string) (string, bool, error) {
+	if global.GVA_REDIS == nil {
+		return PresenceOffline, false, nil
+	}
+	now := time.Now()
+	if last, ok := heartbeats.Load(conn); !ok || now.Sub(last.(time.Time)) >= HeartbeatInterval {
+		heartbeats.Store(conn, now)
+		global.GVA_DB.Model(&model.UserBasic{}).Where("id = ?", userID).
+			Update("heartbeat_time", uint64(now.Unix()))
+	}
+	ctx := context.Background()
+	key := presenceKey(userID)
+	v, err := global.GVA_REDIS.HGet(ctx, key, conn).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return PresenceOffline, false, err
+	}
+	expiry, away, ok := parsePresenceEntry(v)
+	if !ok || expiry < now.Unix() {
+		return updatePresence(userID, conn, away, false)
+	}
+	pipe := global.GVA_REDIS.TxPipeline()
+	pipe.HSet(ctx, key, conn, presenceEntry(away))
+	pipe.Expire(ctx, key, PresenceTTL)
+	_, err = pipe.Exec(ctx)
+	return "", false, err
+}
+
+// DisconnectPresence removes a closed connection of userID.
+func DisconnectPresence(userID uint, conn string) (string, bool, error) {
+	heartbeats.Delete(conn)
+	return updatePresence(userID, conn, false, true)
+}
+
+// CheckWatch returns ErrWatchForbidden unless viewer may watch the presence
+// of userID: themselves, an accepted contact or a member of a room they
+// share.
+func CheckWatch(viewer, userID uint) error {
+	if viewer == userID || global.GVA_DB == nil {
+		return nil
+	}
+	friends, err := AreFriends(viewer, userID)
+	if err != nil || friends {
+		return err
+	}
+	var n int64
+	err = global.GVA_DB.Model(&model.RoomMember{}).
+		Where("user_id = ?", userID).
+		Where("room_id IN (?)", global.GVA_DB.Model(&model.RoomMember{}).Select("room_id").Where("user_id = ?", viewer)).
+		Limit(1).Count(&n).Error
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrWatchForbidden
+	}
+	return nil
+}
+
+// GetPresence returns the current status of userID as seen by viewer. Users
+// who are not online report when they were last seen, if their privacy
+// settings let viewer see it. Users blocked either way always look offline.
+func GetPresence(viewer, userID uint) (*Presence, error) {
+	p := &Presence{UserID: userID, Status: PresenceOffline}
+	hidden := false
+	if global.GVA_DB != nil {
+		blocked, err := Blocked(viewer, userID)
+		if err != nil {
+			return nil, err
+		}
+		hidden = blocked
+	}
+	if global.GVA_REDIS != nil && !hidden {
+		status, err := presenceStatus(context.Background(), userID)
+		if err != nil {
+			return nil, err
+		}
+		p.Status = status
+	}
+	if p.Status == PresenceOnline || global.GVA_DB == nil {
+		return p, nil
+	}
+	var user model.UserBasic
+	if err := global.GVA_DB.Select("id", "heartbeat_time", "logout_time").First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("user not found")
+		}
+		return nil, err
+	}
+	if hidden {
+		return p, nil
+	}
+	if ok, err := lastSeenVisible(userID, viewer); err != nil || !ok {
+		return p, err
+	}
+	p.LastSeen = lastSeen(&user)
+	return p, nil
+}
+
+// lastSeen returns when user last had a connection, or nil if never.
+func lastSeen(user *model.UserBasic) *time.Time {
+	seen := user.HeartbeatTime
+	if user.LogoutTime > seen {
+		seen = user.LogoutTime
+	}
+	if seen == 0 {
+		return nil
+	}
+	t := time.Unix(int64(seen), 0)
+	return &t
+}
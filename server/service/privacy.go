@@ -0,0 +1,124 @@
+package service
+
+import (
+	"chat/global"
+	"chat/model"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm/clause"
+)
+
+// ErrInvalidAudience is returned for a privacy setting other than
+// everyone, contacts or nobody.
+var ErrInvalidAudience = errors.New("invalid audience")
+
+// GetPrivacy returns the privacy settings of uid, with defaults filled in.
+func GetPrivacy(uid uint) (*model.PrivacySettings, error) {
+	s := model.PrivacySettings{UserID: uid}
+	if err := global.GVA_DB.Where("user_id = ?", uid).Limit(1).Find(&s).Error; err != nil {
+		return nil, err
+	}
+	privacyDefaults(&s)
+	return &s, nil
+}
+
+// privacyOf returns the privacy settings of each of uids, with defaults
+// filled in.
+func privacyOf(uids []uint) (map[uint]model.PrivacySettings, error) {
+	out := make(map[uint]model.PrivacySettings, len(uids))
+	if len(uids) == 0 {
+		return out, nil
+	}
+	var rows []model.PrivacySettings
+	if err := global.GVA_DB.Where("user_id IN ?", uids).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, s := range rows {
+		out[s.UserID] = s
+	}
+	for _, uid := range uids {
+		s, ok := out[uid]
+		if !ok {
+			s.UserID = uid
+		}
+		privacyDefaults(&s)
+		out[uid] = s
+	}
+	return out, nil
+}
+
+func privacyDefaults(s *model.PrivacySettings) {
+	for _, f := range []*string{&s.LastSeen, &s.Avatar, &s.ContactLookup} {
+		if *f == "" {
+			*f = model.VisibleEveryone
+		}
+	}
+}
+
+// UpdatePrivacy changes the settings of uid that are not nil.
+func UpdatePrivacy(uid uint, lastSeen, avatar, contactLookup *string) (*model.PrivacySettings, error) {
+	s, err := GetPrivacy(uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range []struct {
+		value *string
+		field *string
+	}{{lastSeen, &s.LastSeen}, {avatar, &s.Avatar}, {contactLookup, &s.ContactLookup}} {
+		if f.value == nil {
+			continue
+		}
+		switch *f.value {
+		case model.VisibleEveryone, model.VisibleContacts, model.VisibleNobody:
+			*f.field = *f.value
+		default:
+			return nil, fmt.Errorf("%w %q", ErrInvalidAudience, *f.value)
+		}
+	}
+	err = global.GVA_DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(s).Error
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// visibleTo reports whether viewer is in audience of owner's setting. Owners
+// always see their own profile and blocked users never see it. viewer is 0
+// for anonymous requests.
+func visibleTo(audience string, owner, viewer uint) (bool, error) {
+	if owner == viewer {
+		return true, nil
+	}
+	if audience == model.VisibleNobody {
+		return false, nil
+	}
+	if viewer == 0 {
+		return audience == model.VisibleEveryone, nil
+	}
+	if blocked, err := Blocked(owner, viewer); err != nil || blocked {
+		return false, err
+	}
+	if audience == model.VisibleEveryone {
+		return true, nil
+	}
+	return AreFriends(owner, viewer)
+}
+
+// AvatarVisible reports whether viewer may see the uploaded avatar of owner.
+func AvatarVisible(owner, viewer uint) (bool, error) {
+	s, err := GetPrivacy(owner)
+	if err != nil {
+		return false, err
+	}
+	return visibleTo(s.Avatar, owner, viewer)
+}
+
+// lastSeenVisible reports whether viewer may see when owner was last online.
+func lastSeenVisible(owner, viewer uint) (bool, error) {
+	s, err := GetPrivacy(owner)
+	if err != nil {
+		return false, err
+	}
+	return visibleTo(s.LastSeen, owner, viewer)
+}
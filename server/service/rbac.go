@@ -0,0 +1,297 @@
+package service
+
+import (
+	"chat/global"
+	"chat/model"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrRoleNotFound = errors.New("role not found")
+	ErrSuspended    = errors.New("account suspended")
+	ErrTokenRevoked = errors.New("token revoked")
+	ErrSelfSuspend  = errors.New("cannot suspend yourself")
+	ErrNotSuspended = errors.New("account not suspended")
+)
+
+// permissionDescriptions lists every permission SeedRBAC creates.
+var permissionDescriptions = map[string]string{
+	model.PermUserManage:       "Change, suspend and log out any account",
+	model.PermRoleManage:       "Grant and revoke roles",
+	model.PermRoomModerate:     "Remove members from any room",
+	model.PermMessageDeleteAny: "Delete messages sent by others",
+}
+
+// defaultRoles are the roles SeedRBAC creates, with their permissions.
+// Permissions added to a role here are granted on the next start; ones
+// removed are not revoked.
+var defaultRoles = map[string][]string{
+	model.RoleAdmin: {model.PermUserManage, model.PermRoleManage, model.PermRoomModerate, model.PermMessageDeleteAny},
+	"operator":      {model.PermUserManage},
+	"moderator":     {model.PermRoomModerate, model.PermMessageDeleteAny},
+}
+
+// SeedRBAC creates the known permissions and default roles when missing.
+func SeedRBAC() error {
+	return global.GVA_DB.Transaction(func(tx *gorm.DB) error {
+		perms := make(map[string]uint, len(permissionDescriptions))
+		for name, desc := range permissionDescriptions {
+			p := model.Permission{Name: name, Description: desc}
+			if err := tx.Where(model.Permission{Name: name}).FirstOrCreate(&p).Error; err != nil {
+				return err
+			}
+			perms[name] = p.ID
+		}
+		for name, granted := range defaultRoles {
+			r := model.Role{Name: name}
+			if err := tx.Where(model.Role{Name: name}).FirstOrCreate(&r).Error; err != nil {
+				return err
+			}
+			for _, perm := range granted {
+				rp := model.RolePermission{RoleID: r.ID, PermissionID: perms[perm]}
+				if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rp).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// HasPermission reports whether uid holds perm through one of their roles.
+// Administrators hold every permission.
+func HasPermission(uid uint, perm string) (bool, error) {
+	admin, err := IsAdmin(uid)
+	if err != nil || admin {
+		return admin, err
+	}
+	var n int64
+	err = global.GVA_DB.Model(&model.UserRole{}).
+		Joins("JOIN role_permissions ON role_permissions.role_id = user_roles.role_id").
+		Joins("JOIN permissions ON permissions.id = role_permissions.permission_id").
+		Where("user_roles.user_id = ? AND permissions.name = ?", uid, perm).Count(&n).Error
+	return n > 0, err
+}
+
+// ListRoles returns every role, by name.
+func ListRoles() ([]model.Role, error) {
+	var roles []model.Role
+	err := global.GVA_DB.Order("name asc").Find(&roles).Error
+	return roles, err
+}
+
+// GrantRole gives uid the role named role. Granting a role twice is a no-op.
+func GrantRole(actor, uid uint, role string) error {
+	var r model.Role
+	if err := global.GVA_DB.Where("name = ?", role).First(&r).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrRoleNotFound
+		}
+		return err
+	}
+	if err := userExists(uid); err != nil {
+		return err
+	}
+	return global.GVA_DB.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&model.UserRole{UserID: uid, RoleID: r.ID, GrantedBy: actor}).Error
+}
+
+// RevokeRole takes the role named role from uid.
+func RevokeRole(uid uint, role string) error {
+	var r model.Role
+	if err := global.GVA_DB.Where("name = ?", role).First(&r).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrRoleNotFound
+		}
+		return err
+	}
+	result := global.GVA_DB.Where("user_id = ? AND role_id = ?", uid, r.ID).Delete(&model.UserRole{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRoleNotFound
+	}
+	return nil
+}
+
+// userRoles returns the role names of each of uids.
+func userRoles(uids []uint) (map[uint][]string, error) {
+	var rows []struct {
+		UserID uint
+		Name   string
+	}
+	out := make(map[uint][]string, len(uids))
+	if len(uids) == 0 {
+		return out, nil
+	}
+	err := global.GVA_DB.Model(&model.UserRole{}).Select("user_roles.user_id, roles.name").
+		Joins("JOIN roles ON roles.id = user_roles.role_id").
+		Where("user_roles.user_id IN ?", uids).Order("roles.name asc").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		out[r.UserID] = append(out[r.UserID], r.Name)
+	}
+	return out, nil
+}
+
+func userExists(uid uint) error {
+	var user model.UserBasic
+	if err := global.GVA_DB.Select("id").First(&user, uid).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("user not found")
+		}
+		return err
+	}
+	return nil
+}
+
+// AdminUser is an account as shown to operators.
+type AdminUser struct {
+	ID          uint       `json:"id"`
+	Name        string     `json:"name"`
+	Email       string     `json:"email"`
+	Phone       string     `json:"phone"`
+	Identity    string     `json:"identity,omitempty"`
+	Roles       []string   `json:"roles"`
+	SuspendedAt *time.Time `json:"suspended_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// AdminListUsers returns a page of accounts, newest first. before is the
+// id cursor of the next page; suspended only returns suspended accounts.
+func AdminListUsers(before uint, limit int, suspended bool) ([]AdminUser, bool, error) {
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	q := global.GVA_DB.Model(&model.UserBasic{})
+	if before > 0 {
+		q = q.Where("id < ?", before)
+	}
+	if suspended {
+		q = q.Where("suspended_at IS NOT NULL")
+	}
+	var users []model.UserBasic
+	if err := q.Order("id desc").Limit(limit + 1).Find(&users).Error; err != nil {
+		return nil, false, err
+	}
+	hasMore := len(users) > limit
+	if hasMore {
+		users = users[:limit]
+	}
+	ids := make([]uint, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+	roles, err := userRoles(ids)
+	if err != nil {
+		return nil, false, err
+	}
+	out := make([]AdminUser, len(users))
+	for i, u := range users {
+		out[i] = AdminUser{ID: u.ID, Name: u.Name, Email: u.Email, Phone: u.Phone, Identity: u.Identity,
+			Roles: roles[u.ID], SuspendedAt: u.SuspendedAt, CreatedAt: u.CreatedAt}
+		if out[i].Roles == nil {
+			out[i].Roles = []string{}
+		}
+	}
+	return out, hasMore, nil
+}
+
+// SuspendUser suspends uid and revokes their tokens. actor must be allowed
+// to manage uid, and nobody suspends themselves.
+func SuspendUser(actor, uid uint) error {
+	if actor == uid {
+		return ErrSelfSuspend
+	}
+	if err := CanManageUser(actor, uid); err != nil {
+		return err
+	}
+	now := time.Now()
+	return global.GVA_DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.UserBasic{}).Where("id = ?", uid).
+			Updates(map[string]interface{}{"suspended_at": now, "tokens_revoked_at": uint64(now.Unix())})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("user not found")
+		}
+		return revokeSessions(tx, uid)
+	})
+}
+
+// RestoreUser lifts the suspension of uid. Tokens and sessions revoked by
+// the suspension stay revoked; the user logs in again.
+func RestoreUser(uid uint) error {
+	if err := userExists(uid); err != nil {
+		return err
+	}
+	result := global.GVA_DB.Model(&model.UserBasic{}).Where("id = ? AND suspended_at IS NOT NULL", uid).
+		Update("suspended_at", nil)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotSuspended
+	}
+	return nil
+}
+
+// RevokeTokens invalidates every token issued to uid so far and ends their
+// sessions, so refresh tokens stop working too.
+func RevokeTokens(uid uint) error {
+	return global.GVA_DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.UserBasic{}).Where("id = ?", uid).
+			Update("tokens_revoked_at", uint64(time.Now().Unix()))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("user not found")
+		}
+		return revokeSessions(tx, uid)
+	})
+}
+
+// CheckTokenAccess returns ErrSuspended or ErrTokenRevoked when a token
+// issued to uid at issuedAt (Unix seconds) for session sid may no longer be
+// used.
+func CheckTokenAccess(uid uint, issuedAt int64, sid string) error {
+	var user model.UserBasic
+	if err := global.GVA_DB.Select("id", "suspended_at", "tokens_revoked_at").First(&user, uid).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("user not found")
+		}
+		return err
+	}
+	return tokenAccess(&user, issuedAt, sid)
+}
+
+// tokenAccess checks a token of user issued at issuedAt for session sid.
+// Tokens of a session live and die with it, so logging in again right after
+// a revocation works; tokens from before sessions existed carry no sid and
+// are checked against TokensRevokedAt instead.
+func tokenAccess(user *model.UserBasic, issuedAt int64, sid string) error {
+	if user.SuspendedAt != nil {
+		return ErrSuspended
+	}
+	if sid != "" {
+		return checkSession(user.ID, sid)
+	}
+	// a token from the second of the revocation may predate it, so it goes too
+	if user.TokensRevokedAt > 0 && issuedAt <= int64(user.TokensRevokedAt) {
+		return ErrTokenRevoked
+	}
+	return nil
+}
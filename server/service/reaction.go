@@ -0,0 +1,113 @@
+package service
+
+import (
+	"chat/global"
+	"chat/model"
+	"errors"
+	"unicode"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Longest reaction accepted, in runes; enough for emoji with modifiers and
+// joiners.
+const maxEmojiLength = 16
+
+var ErrInvalidEmoji = errors.New("invalid emoji")
+
+func validEmoji(e string) bool {
+	n := utf8.RuneCountInString(e)
+	if n == 0 || n > maxEmojiLength || len(e) > 64 || !utf8.ValidString(e) {
+		return false
+	}
+	for _, r := range e {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// visibleMessage loads messageID if userID takes part in its conversation.
+func visibleMessage(userID, messageID uint) (*model.Message, error) {
+	var m model.Message
+	if err := global.GVA_DB.First(&m, messageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	if _, _, err := conversationOf(&m, userID); err != nil {
+		return nil, err
+	}
+	if m.Tombstone {
+		return nil, ErrMessageDeleted
+	}
+	return &m, nil
+}
+
+// AddReaction records userID's emoji reaction to messageID. It returns the
+// message and whether the reaction is new.
+func AddReaction(userID, messageID uint, emoji string) (*model.Message, bool, error) {
+	if !validEmoji(emoji) {
+		return nil, false, ErrInvalidEmoji
+	}
+	m, err := visibleMessage(userID, messageID)
+	if err != nil {
+		return nil, false, err
+	}
+	result := global.GVA_DB.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&model.MessageReaction{MessageID: m.ID, UserID: userID, Emoji: emoji})
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	return m, result.RowsAffected > 0, nil
+}
+
+// RemoveReaction deletes userID's emoji reaction to messageID. It returns the
+// message and whether a reaction was removed.
+func RemoveReaction(userID, messageID uint, emoji string) (*model.Message, bool, error) {
+	m, err := visibleMessage(userID, messageID)
+	if err != nil {
+		return nil, false, err
+	}
+	result := global.GVA_DB.Where("message_id = ? AND user_id = ? AND emoji = ?", m.ID, userID, emoji).
+		Delete(&model.MessageReaction{})
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	return m, result.RowsAffected > 0, nil
+}
+
+// attachReactions fills the Reactions summary of msgs, ordering emoji by
+// their first use.
+func attachReactions(msgs []model.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(msgs))
+	index := make(map[uint]*model.Message, len(msgs))
+	for i := range msgs {
+		ids[i] = msgs[i].ID
+		index[msgs[i].ID] = &msgs[i]
+	}
+	var reactions []model.MessageReaction
+	if err := global.GVA_DB.Where("message_id IN ?", ids).Order("id asc").Find(&reactions).Error; err != nil {
+		return err
+	}
+	for _, r := range reactions {
+		m := index[r.MessageID]
+		i := 0
+		for i < len(m.Reactions) && m.Reactions[i].Emoji != r.Emoji {
+			i++
+		}
+		if i == len(m.Reactions) {
+			m.Reactions = append(m.Reactions, model.ReactionSummary{Emoji: r.Emoji})
+		}
+		m.Reactions[i].Count++
+		m.Reactions[i].Users = append(m.Reactions[i].Users, r.UserID)
+	}
+	return nil
+}
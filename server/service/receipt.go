@@ -0,0 +1,110 @@
+package service
+
+import (
+	"chat/global"
+	"chat/model"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrNotParticipant = errors.New("not a participant of this conversation")
+
+// conversationOf returns the conversation userID shares with the sender or
+// recipient of m: the peer for direct messages, the room otherwise.
+func conversationOf(m *model.Message, userID uint) (peerID uint, room string, err error) {
+	if m.Room != "" {
+		if err := CheckRoomMember(m.Room, userID); err != nil {
+			return 0, "", err
+		}
+		return 0, m.Room, nil
+	}
+	switch userID {
+	case m.To:
+		return m.From, "", nil
+	case m.From:
+		return m.To, "", nil
+	}
+	return 0, "", ErrNotParticipant
+}
+
+// MarkRead moves userID's read watermark in the conversation of messageID up
+// to that message. The returned marker is nil when the watermark was already
+// at or past it. Direct messages from the peer up to the watermark get ReadAt
+// set and are marked delivered, and the conversation's unread count is reset
+// once its latest message has been read.
+func MarkRead(userID, messageID uint) (*model.ReadMarker, error) {
+	var m model.Message
+	if err := global.GVA_DB.First(&m, messageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	peerID, room, err := conversationOf(&m, userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var marker *model.ReadMarker
+	err = global.GVA_DB.Transaction(func(tx *gorm.DB) error {
+		var cur model.ReadMarker
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND peer_id = ? AND room = ?", userID, peerID, room).First(&cur).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			cur = model.ReadMarker{UserID: userID, PeerID: peerID, Room: room}
+		case err != nil:
+			return err
+		case cur.LastReadID >= messageID:
+			return nil
+		}
+		cur.LastReadID, cur.ReadAt = messageID, now
+		if err := tx.Save(&cur).Error; err != nil {
+			return err
+		}
+		if room == "" {
+			err := tx.Model(&model.Message{}).
+				Where("`from` = ? AND `to` = ? AND room = '' AND id <= ? AND read_at IS NULL", peerID, userID, messageID).
+				Updates(map[string]interface{}{"read_at": now, "delivered": true, "delivered_at": gorm.Expr("COALESCE(delivered_at, ?)", now)}).Error
+			if err != nil {
+				return err
+			}
+		}
+		marker = &cur
+		return tx.Model(&model.Conversation{}).
+			Where("owner_id = ? AND peer_id = ? AND room = ? AND last_message_id <= ?", userID, peerID, room, messageID).
+			Update("unread", 0).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return marker, nil
+}
+
+// GetMessageReads returns the read markers of the users other than its
+// sender who have read messageID. userID must be a participant of the
+// message's conversation.
+func GetMessageReads(userID, messageID uint) ([]model.ReadMarker, error) {
+	var m model.Message
+	if err := global.GVA_DB.First(&m, messageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	if _, _, err := conversationOf(&m, userID); err != nil {
+		return nil, err
+	}
+	db := global.GVA_DB.Where("last_read_id >= ? AND user_id <> ?", m.ID, m.From)
+	if m.Room != "" {
+		db = db.Where("room = ?", m.Room)
+	} else {
+		db = db.Where("user_id = ? AND peer_id = ? AND room = ''", m.To, m.From)
+	}
+	var reads []model.ReadMarker
+	err := db.Order("read_at asc").Find(&reads).Error
+	return reads, err
+}
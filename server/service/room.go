@@ -0,0 +1,200 @@
+package service
+
+import (
+	"chat/global"
+	"chat/model"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRoomNotFound  = errors.New("room not found")
+	ErrNotRoomMember = errors.New("not a room member")
+	ErrRoomForbidden = errors.New("insufficient room role")
+	ErrInvalidRole   = errors.New("invalid room role")
+)
+
+// ParseRoomID converts a websocket room_id into a room primary key.
+func ParseRoomID(s string) (uint, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("invalid room id %q", s)
+	}
+	return uint(id), nil
+}
+
+// CreateRoom creates a room owned by ownerID with the owner as its first
+// member and members as plain members, all or nothing. It returns the room
+// and the ids of the members added besides the owner.
+func CreateRoom(ownerID uint, name string, members []uint) (*model.Room, []uint, error) {
+	if name == "" {
+		return nil, nil, fmt.Errorf("room name required")
+	}
+	room := &model.Room{Name: name, OwnerID: ownerID}
+	added := make([]uint, 0, len(members))
+	err := global.GVA_DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(room).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&model.RoomMember{RoomID: room.ID, UserID: ownerID, Role: model.RoomRoleOwner}).Error; err != nil {
+			return err
+		}
+		seen := map[uint]bool{ownerID: true}
+		for _, id := range members {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			var user model.UserBasic
+			if err := tx.Select("id").First(&user, id).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return fmt.Errorf("user not found")
+				}
+				return err
+			}
+			if err := tx.Create(&model.RoomMember{RoomID: room.ID, UserID: id, Role: model.RoomRoleMember}).Error; err != nil {
+				return err
+			}
+			added = append(added, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return room, added, nil
+}
+
+// GetRoom loads a room by id.
+func GetRoom(roomID uint) (*model.Room, error) {
+	var room model.Room
+	if err := global.GVA_DB.First(&room, roomID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRoomNotFound
+		}
+		return nil, err
+	}
+	return &room, nil
+}
+
+// GetRoomMember returns the membership of userID in roomID, or
+// ErrNotRoomMember.
+func GetRoomMember(roomID, userID uint) (*model.RoomMember, error) {
+	var m model.RoomMember
+	if err := global.GVA_DB.Where("room_id = ? AND user_id = ?", roomID, userID).First(&m).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotRoomMember
+		}
+		return nil, err
+	}
+	return &m, nil
+}
+
+// CheckRoomMember resolves a websocket room_id and verifies userID belongs to
+// it.
+func CheckRoomMember(roomID string, userID uint) error {
+	id, err := ParseRoomID(roomID)
+	if err != nil {
+		return err
+	}
+	_, err = GetRoomMember(id, userID)
+	return err
+}
+
+// AddRoomMember lets actorID add userID to roomID with role. Owners and admins
+// may invite members; only the owner may appoint admins.
+func AddRoomMember(actorID, roomID, userID uint, role string) (*model.RoomMember, error) {
+	if role == "" {
+		role = model.RoomRoleMember
+	}
+	if role != model.RoomRoleMember && role != model.RoomRoleAdmin {
+		return nil, ErrInvalidRole
+	}
+	if _, err := GetRoom(roomID); err != nil {
+		return nil, err
+	}
+	actor, err := GetRoomMember(roomID, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if !actor.CanManage() || (role == model.RoomRoleAdmin && actor.Role != model.RoomRoleOwner) {
+		return nil, ErrRoomForbidden
+	}
+	var user model.UserBasic
+	if err := global.GVA_DB.First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("user not found")
+		}
+		return nil, err
+	}
+	if existing, err := GetRoomMember(roomID, userID); err == nil {
+		return existing, nil
+	} else if !errors.Is(err, ErrNotRoomMember) {
+		return nil, err
+	}
+	member := &model.RoomMember{RoomID: roomID, UserID: userID, Role: role}
+	if err := global.GVA_DB.Create(member).Error; err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// RemoveRoomMember lets actorID remove userID from roomID. Anyone but the
+// owner may leave; owners remove anyone else and admins remove members.
+// Holders of room.moderate remove anyone but the owner from any room.
+func RemoveRoomMember(actorID, roomID, userID uint) error {
+	target, err := GetRoomMember(roomID, userID)
+	if err != nil {
+		return err
+	}
+	if target.Role == model.RoomRoleOwner {
+		return ErrRoomForbidden
+	}
+	moderator := false
+	if actorID != userID {
+		if moderator, err = HasPermission(actorID, model.PermRoomModerate); err != nil {
+			return err
+		}
+	}
+	if actorID != userID && !moderator {
+		actor, err := GetRoomMember(roomID, actorID)
+		if err != nil {
+			return err
+		}
+		if !actor.CanManage() || (target.Role == model.RoomRoleAdmin && actor.Role != model.RoomRoleOwner) {
+			return ErrRoomForbidden
+		}
+	}
+	return global.GVA_DB.Delete(target).Error
+}
+
+// ListRoomMembers returns the members of roomID, oldest first.
+func ListRoomMembers(roomID uint) ([]model.RoomMember, error) {
+	var members []model.RoomMember
+	err := global.GVA_DB.Where("room_id = ?", roomID).Order("id asc").Find(&members).Error
+	return members, err
+}
+
+// ListUserRooms returns the rooms userID belongs to.
+func ListUserRooms(userID uint) ([]model.Room, error) {
+	var rooms []model.Room
+	err := global.GVA_DB.Joins("JOIN room_members ON room_members.room_id = rooms.id").
+		Where("room_members.user_id = ?", userID).Order("rooms.id asc").Find(&rooms).Error
+	return rooms, err
+}
+
+// ListUserRoomIDs returns the websocket room ids userID belongs to.
+func ListUserRoomIDs(userID uint) ([]string, error) {
+	var ids []uint
+	if err := global.GVA_DB.Model(&model.RoomMember{}).Where("user_id = ?", userID).Pluck("room_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		out[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return out, nil
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"chat/global"
+	"chat/model"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// RefreshTokenTTL is how long a refresh token may be exchanged. Each
+// exchange issues a new token, so sessions in use do not expire.
+var RefreshTokenTTL = 30 * 24 * time.Hour
+
+// RotatedTokenRetention is how long an exchanged refresh token is kept to
+// detect its reuse. Older ones are purged and refused as unknown instead.
+var RotatedTokenRetention = 7 * 24 * time.Hour
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// issueRefreshToken stores a new refresh token of family and returns it.
+func issueRefreshToken(tx *gorm.DB, uid uint, family, ip, userAgent string) (string, error) {
+	b, err := randomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	s := model.Session{UserID: uid, FamilyID: family, TokenHash: hashRefreshToken(token),
+		IP: ip, UserAgent: userAgent, ExpiresAt: time.Now().Add(RefreshTokenTTL)}
+	return token, tx.Create(&s).Error
+}
+
+// CreateSession starts a session for uid and returns its id, for the sid
+// claim of access tokens, and its first refresh token.
+func CreateSession(uid uint, ip, userAgent string) (sid, refresh string, err error) {
+	b, err := randomBytes(16)
+	if err != nil {
+		return "", "", err
+	}
+	sid = hex.EncodeToString(b)
+	refresh, err = issueRefreshToken(global.GVA_DB, uid, sid, ip, userAgent)
+	if err != nil {
+		return "", "", err
+	}
+	return sid, refresh, nil
+}
+
+// RefreshSession exchanges refresh for a new refresh token of the same
+// session and returns the session's user, the exchanged token's record and
+// the new token. A token that was already exchanged revokes the whole
+// session and returns ErrRefreshTokenReused along with its record, so the
+// caller can close the session's connections.
+func RefreshSession(refresh, ip, userAgent string) (*model.UserBasic, *model.Session, string, error) {
+	var (
+		user   model.UserBasic
+		s      model.Session
+		next   string
+		reused bool
+	)
+	err := global.GVA_DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", hashRefreshToken(refresh)).First(&s).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRefreshTokenInvalid
+			}
+			return err
+		}
+		now := time.Now()
+		if s.RevokedAt != nil || now.After(s.ExpiresAt) {
+			return ErrRefreshTokenInvalid
+		}
+		if s.RotatedAt != nil {
+			// someone else holds the newer token; end the session for both
+			reused = true
+			return revokeFamily(tx, s.FamilyID)
+		}
+		if err := tx.First(&user, s.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRefreshTokenInvalid
+			}
+			return err
+		}
+		if user.SuspendedAt != nil {
+			return ErrSuspended
+		}
+		if err := tx.Model(&s).Update("rotated_at", now).Error; err != nil {
+			return err
+		}
+		var err error
+		next, err = issueRefreshToken(tx, s.UserID, s.FamilyID, ip, userAgent)
+		return err
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if reused {
+		return nil, &s, "", ErrRefreshTokenReused
+	}
+	return &user, &s, next, nil
+}
+
+// RevokeSession ends the session sid of uid.
+func RevokeSession(uid uint, sid string) error {
+	return global.GVA_DB.Model(&model.Session{}).
+		Where("user_id = ? AND family_id = ? AND revoked_at IS NULL", uid, sid).
+		Update("revoked_at", time.Now()).Error
+}
+
+func revokeFamily(tx *gorm.DB, family string) error {
+	return tx.Model(&model.Session{}).Where("family_id = ? AND revoked_at IS NULL", family).
+		Update("revoked_at", time.Now()).Error
+}
+
+// revokeSessions ends every session of uid.
+func revokeSessions(tx *gorm.DB, uid uint) error {
+	return tx.Model(&model.Session{}).Where("user_id = ? AND revoked_at IS NULL", uid).
+		Update("revoked_at", time.Now()).Error
+}
+
+// checkSession returns ErrTokenRevoked when the session sid of uid ended.
+func checkSession(uid uint, sid string) error {
+	var n int64
+	err := global.GVA_DB.Model(&model.Session{}).
+		Where("user_id = ? AND family_id = ? AND revoked_at IS NULL", uid, sid).Count(&n).Error
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// PurgeSessions deletes refresh tokens that can no longer be exchanged:
+// expired and revoked ones, and exchanged ones past RotatedTokenRetention.
+func PurgeSessions() {
+	now := time.Now()
+	result := global.GVA_DB.
+		Where("expires_at < ? OR revoked_at IS NOT NULL OR rotated_at < ?", now, now.Add(-RotatedTokenRetention)).
+		Delete(&model.Session{})
+	if result.Error != nil {
+		log.Printf("purge sessions: %v", result.Error)
+	}
+}
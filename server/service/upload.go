@@ -0,0 +1,287 @@
+package service
+
+import (
+	"chat/global"
+	"chat/model"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Resumable upload limits. They are set from config at startup.
+var (
+	// UploadDir holds partial uploads. It must be on local disk, so clients
+	// resuming an upload have to reach the same instance.
+	UploadDir = filepath.Join("tmp", "uploads")
+
+	// UploadMaxSize is the largest resumable upload in bytes.
+	UploadMaxSize int64 = 1 << 30
+
+	// UploadQuota caps the bytes a user may hold in attachments and
+	// unfinished uploads together.
+	UploadQuota int64 = 5 << 30
+
+	// UploadExpiry is how long an unfinished upload may sit idle before it
+	// is purged.
+	UploadExpiry = 24 * time.Hour
+)
+
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrUploadTooLarge = errors.New("upload too large")
+	ErrUploadOffset   = errors.New("upload offset mismatch")
+	ErrUploadBusy     = errors.New("upload is being written")
+	ErrUploadComplete = errors.New("upload already complete")
+	ErrQuotaExceeded  = errors.New("storage quota exceeded")
+)
+
+// uploadLocks serialises writes to the same upload on this instance.
+var uploadLocks sync.Map
+
+func uploadPath(id string) string {
+	return filepath.Join(UploadDir, id)
+}
+
+// usedBytes is what ownerID holds in attachments and unfinished uploads.
+func usedBytes(tx *gorm.DB, ownerID uint) (int64, error) {
+	var attachments, pending int64
+	if err := tx.Model(&model.Attachment{}).Where("owner_id = ?", ownerID).
+		Select("COALESCE(SUM(size), 0)").Scan(&attachments).Error; err != nil {
+		return 0, err
+	}
+	if err := tx.Model(&model.Upload{}).Where("owner_id = ? AND attachment_id IS NULL", ownerID).
+		Select("COALESCE(SUM(length), 0)").Scan(&pending).Error; err != nil {
+		return 0, err
+	}
+	return attachments + pending, nil
+}
+
+// withinQuota runs create in a transaction once ownerID's usage plus size
+// fits UploadQuota. The transaction locks the owner's user row, so
+// concurrent uploads of one user are checked one after the other and cannot
+// overshoot the quota together.
+func withinQuota(ownerID uint, size int64, create func(tx *gorm.DB) error) error {
+	return global.GVA_DB.Transaction(func(tx *gorm.DB) error {
+		var owner model.UserBasic
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&owner, ownerID).Error; err != nil {
+			return err
+		}
+		used, err := usedBytes(tx, ownerID)
+		if err != nil {
+			return err
+		}
+		if used+size > UploadQuota {
+			return ErrQuotaExceeded
+		}
+		return create(tx)
+	})
+}
+
+// CreateUpload reserves an upload of length bytes for ownerID.
+func CreateUpload(ownerID uint, length int64, name string) (*model.Upload, error) {
+	if length <= 0 {
+		return nil, fmt.Errorf("upload length must be positive")
+	}
+	if length > UploadMaxSize {
+		return nil, ErrUploadTooLarge
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	u := &model.Upload{ID: hex.EncodeToString(b), OwnerID: ownerID, Length: length, Name: cleanFileName(name)}
+	if err := os.MkdirAll(UploadDir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(uploadPath(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	err = withinQuota(ownerID, length, func(tx *gorm.DB) error {
+		return tx.Create(u).Error
+	})
+	if err != nil {
+		os.Remove(uploadPath(u.ID))
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetUpload returns upload id of ownerID.
+func GetUpload(ownerID uint, id string) (*model.Upload, error) {
+	var u model.Upload
+	if err := global.GVA_DB.Where("id = ? AND owner_id = ?", id, ownerID).First(&u).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+// WriteUpload appends data from r to upload id, which must currently be at
+// offset. Whatever arrives before r fails is kept, so the client can resume
+// from the returned offset. Once the upload is complete it is stored as an
+// attachment.
+func WriteUpload(ownerID uint, id string, offset int64, r io.Reader) (*model.Upload, error) {
+	mu, ok := lockUpload(id)
+	if !ok {
+		return nil, ErrUploadBusy
+	}
+	defer mu.Unlock()
+
+	u, err := GetUpload(ownerID, id)
+	if err != nil {
+		return nil, err
+	}
+	if u.AttachmentID != nil {
+		return u, ErrUploadComplete
+	}
+	if offset != u.Offset {
+		return u, ErrUploadOffset
+	}
+	f, err := os.OpenFile(uploadPath(id), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	// drop anything past the recorded offset left by an interrupted write
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	n, werr := io.Copy(f, io.LimitReader(r, u.Length-offset))
+	if err := f.Close(); werr == nil {
+		werr = err
+	}
+	if n > 0 {
+		u.Offset += n
+		if err := global.GVA_DB.Model(u).Update("offset", u.Offset).Error; err != nil {
+			return nil, err
+		}
+	}
+	if werr != nil {
+		return u, werr
+	}
+	if u.Offset == u.Length {
+		if err := finishUpload(u); err != nil {
+			return u, err
+		}
+	}
+	return u, nil
+}
+
+// finishUpload moves a complete upload into storage as an attachment.
+func finishUpload(u *model.Upload) error {
+	f, err := os.Open(uploadPath(u.ID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// the upload already counts against the quota
+	a, err := storeAttachment(u.OwnerID, u.Name, f, u.Length, false)
+	if errors.Is(err, ErrInvalidImage) || errors.Is(err, ErrImageTooLarge) {
+		// resuming cannot fix a broken file
+		if rerr := removeUpload(u); rerr != nil {
+			log.Printf("remove rejected upload %s: %v", u.ID, rerr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	u.AttachmentID = &a.ID
+	if err := global.GVA_DB.Model(u).Update("attachment_id", a.ID).Error; err != nil {
+		return err
+	}
+	if err := os.Remove(uploadPath(u.ID)); err != nil {
+		log.Printf("remove partial upload %s: %v", u.ID, err)
+	}
+	uploadLocks.Delete(u.ID)
+	return nil
+}
+
+// DeleteUpload abandons an unfinished upload of ownerID.
+func DeleteUpload(ownerID uint, id string) error {
+	mu, ok := lockUpload(id)
+	if !ok {
+		return ErrUploadBusy
+	}
+	defer mu.Unlock()
+	u, err := GetUpload(ownerID, id)
+	if err != nil {
+		return err
+	}
+	if u.AttachmentID != nil {
+		return ErrUploadComplete
+	}
+	return removeUpload(u)
+}
+
+// lockUpload takes the write lock of upload id unless a write holds it.
+func lockUpload(id string) (*sync.Mutex, bool) {
+	lock, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := lock.(*sync.Mutex)
+	return mu, mu.TryLock()
+}
+
+// removeUpload deletes u and its partial file. Callers hold its lock. The
+// lock is forgotten last, so a writer that finds no lock afterwards also
+// finds no upload.
+func removeUpload(u *model.Upload) error {
+	if err := os.Remove(uploadPath(u.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := global.GVA_DB.Delete(u).Error; err != nil {
+		return err
+	}
+	uploadLocks.Delete(u.ID)
+	return nil
+}
+
+// PurgeUploads removes unfinished uploads idle for longer than UploadExpiry.
+// Uploads being written are skipped, and each is checked again under its
+// lock in case a write moved it on meanwhile.
+func PurgeUploads() {
+	var stale []model.Upload
+	cutoff := time.Now().Add(-UploadExpiry)
+	if err := global.GVA_DB.Where("attachment_id IS NULL AND updated_at < ?", cutoff).Find(&stale).Error; err != nil {
+		log.Printf("purge uploads: %v", err)
+		return
+	}
+	for i := range stale {
+		purgeUpload(stale[i].ID, cutoff)
+	}
+}
+
+func purgeUpload(id string, cutoff time.Time) {
+	mu, ok := lockUpload(id)
+	if !ok {
+		return
+	}
+	defer mu.Unlock()
+	var u model.Upload
+	err := global.GVA_DB.Where("id = ? AND attachment_id IS NULL AND updated_at < ?", id, cutoff).First(&u).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return
+	}
+	if err == nil {
+		err = removeUpload(&u)
+	}
+	if err != nil {
+		log.Printf("purge upload %s: %v", id, err)
+	}
+}
@@ -15,12 +15,6 @@ import (
 	jwtlib "github.com/golang-jwt/jwt/v4"
 )
 
-func GetUserList() (users []model.UserBasic) {
-	db := global.GVA_DB.Model(model.UserBasic{})
-	db.Find(&users)
-	return
-}
-
 func CreateUser(user *model.UserBasic) (err error) {
 	db := global.GVA_DB
 
@@ -251,15 +245,19 @@ func AuthenticateUser(identifier, password string) (*model.UserBasic, error) {
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PassWord), []byte(password)); err != nil {
 		return nil, fmt.Errorf("invalid credentials")
 	}
+	if user.SuspendedAt != nil {
+		return nil, ErrSuspended
+	}
 
 	return &user, nil
 }
 
-// AuthenticateToken verifies a JWT token string and returns the corresponding user.
+// AuthenticateToken verifies a JWT token string and returns the corresponding user
+// and the session the token belongs to, empty for tokens from before sessions.
 // tokenString may include the "Bearer " prefix.
-func AuthenticateToken(tokenString string) (*model.UserBasic, error) {
+func AuthenticateToken(tokenString string) (*model.UserBasic, string, error) {
 	if tokenString == "" {
-		return nil, fmt.Errorf("token required")
+		return nil, "", fmt.Errorf("token required")
 	}
 	// trim Bearer prefix
 	if strings.HasPrefix(strings.ToLower(tokenString), "bearer ") {
@@ -281,19 +279,19 @@ func AuthenticateToken(tokenString string) (*model.UserBasic, error) {
 		return []byte(secret), nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	if !token.Valid {
-		return nil, fmt.Errorf("invalid token")
+		return nil, "", fmt.Errorf("invalid token")
 	}
 	claims, ok := token.Claims.(jwtlib.MapClaims)
 	if !ok {
-		return nil, fmt.Errorf("invalid token claims")
+		return nil, "", fmt.Errorf("invalid token claims")
 	}
 	// identity key used by middleware is "id"
 	idVal, ok := claims["id"]
 	if !ok {
-		return nil, fmt.Errorf("token missing id claim")
+		return nil, "", fmt.Errorf("token missing id claim")
 	}
 	var uid uint
 	switch v := idVal.(type) {
@@ -304,17 +302,22 @@ func AuthenticateToken(tokenString string) (*model.UserBasic, error) {
 	case int64:
 		uid = uint(v)
 	default:
-		return nil, fmt.Errorf("invalid id claim type")
+		return nil, "", fmt.Errorf("invalid id claim type")
 	}
 
 	var user model.UserBasic
 	if err := global.GVA_DB.First(&user, uid).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, fmt.Errorf("user not found")
+			return nil, "", fmt.Errorf("user not found")
 		}
-		return nil, err
+		return nil, "", err
 	}
-	return &user, nil
+	iat, _ := claims["iat"].(float64)
+	sid, _ := claims["sid"].(string)
+	if err := tokenAccess(&user, int64(iat), sid); err != nil {
+		return nil, "", err
+	}
+	return &user, sid, nil
 }
 
 func jwtSecretFromEnv() string {
@@ -0,0 +1,158 @@
+package ws
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chat/global"
+	"chat/service"
+)
+
+// blocked reports whether a and b blocked each other in either direction.
+// Lookup errors let the frame through rather than silently losing messages.
+func blocked(a, b uint) bool {
+	if global.GVA_DB == nil {
+		return false
+	}
+	ok, err := service.Blocked(a, b)
+	if err != nil {
+		log.Printf("block check %d/%d: %v", a, b, err)
+		return false
+	}
+	return ok
+}
+
+// blockable reports whether m is a frame one user sends another that a block
+// between them must stop: direct messages, typing indicators and friend
+// requests.
+func blockable(m *Message) bool {
+	switch m.Type {
+	case "typing_start", "typing_stop", "friend_request", "friend_accept":
+		return m.RoomID == ""
+	}
+	return isStored(m) && m.RoomID == ""
+}
+
+// blockCacheTTL bounds how long a block check of a pair of users is reused
+// for frames from other instances. Blocking and unblocking forget the pair
+// on every instance holding one of the users, so it only matters for
+// changes those frames miss.
+const blockCacheTTL = 30 * time.Second
+
+// blockCacheSize is the number of cached pairs above which expired ones are
+// swept.
+const blockCacheSize = 10000
+
+// blockCache remembers block checks so frames from other instances do not
+// each cost a query on the broker goroutine. It is used from both the
+// broker goroutine and Run.
+type blockCache struct {
+	mu      sync.Mutex
+	entries map[[2]uint]blockEntry
+}
+
+type blockEntry struct {
+	blocked bool
+	expires time.Time
+}
+
+func newBlockCache() *blockCache {
+	return &blockCache{entries: make(map[[2]uint]blockEntry)}
+}
+
+// pairKey orders a and b so both directions share an entry.
+func pairKey(a, b uint) [2]uint {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]uint{a, b}
+}
+
+// blocked is the cached form of the package-level blocked. Failed lookups
+// are not cached.
+func (bc *blockCache) blocked(a, b uint) bool {
+	key := pairKey(a, b)
+	now := time.Now()
+	bc.mu.Lock()
+	e, ok := bc.entries[key]
+	bc.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.blocked
+	}
+	if global.GVA_DB == nil {
+		return false
+	}
+	ok, err := service.Blocked(a, b)
+	if err != nil {
+		log.Printf("block check %d/%d: %v", a, b, err)
+		return false
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if len(bc.entries) >= blockCacheSize {
+		for k, e := range bc.entries {
+			if !now.Before(e.expires) {
+				delete(bc.entries, k)
+			}
+		}
+	}
+	bc.entries[key] = blockEntry{blocked: ok, expires: now.Add(blockCacheTTL)}
+	return ok
+}
+
+// forget drops the cached check of a and b.
+func (bc *blockCache) forget(a, b uint) {
+	bc.mu.Lock()
+	delete(bc.entries, pairKey(a, b))
+	bc.mu.Unlock()
+}
+
+// dropBlocked reports whether a frame received from another instance on
+// channel must not be delivered because its recipient and sender blocked
+// each other. The sending instance checks too; this catches frames that
+// were published before the block or by an instance that did not.
+func (h *Hub) dropBlocked(channel string, m *Message) bool {
+	uid, ok := strings.CutPrefix(channel, "user:")
+	if !ok || m.From == 0 || !blockable(m) {
+		return false
+	}
+	to, err := strconv.ParseUint(uid, 10, 64)
+	if err != nil {
+		return false
+	}
+	return h.blocks.blocked(uint(to), m.From)
+}
+
+// DropWatches ends every watch a and b hold on each other's presence, on all
+// instances. It is used when one of them blocks the other.
+func (h *Hub) DropWatches(a, b uint) {
+	h.Dispatch(&Message{Type: "unwatched", From: a, To: b})
+	h.Dispatch(&Message{Type: "unwatched", From: b, To: a})
+}
+
+// Unblocked tells all instances that a lifted a block on b, so frames
+// between them are no longer dropped.
+func (h *Hub) Unblocked(a, b uint) {
+	h.Dispatch(&Message{Type: "unblocked", From: a, To: b})
+	h.Dispatch(&Message{Type: "unblocked", From: b, To: a})
+}
+
+// applyBlockChange handles the internal frames sent when uid and m.From
+// block or unblock each other, and reports whether m was one. They forget
+// the cached block check of the pair; unwatched frames also remove the
+// watches uid's local clients hold on m.From. They are never delivered.
+func (h *Hub) applyBlockChange(uid uint, m *Message) bool {
+	if m.Type != "unwatched" && m.Type != "unblocked" {
+		return false
+	}
+	h.blocks.forget(uid, m.From)
+	if m.Type == "unwatched" {
+		for c := range h.users[uid] {
+			h.unwatch(m.From, c)
+		}
+	}
+	return true
+}
@@ -0,0 +1,371 @@
+package ws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Channel names used to fan frames out between hub instances.
+const broadcastChannel = "broadcast"
+
+func userChannel(id uint) string { return fmt.Sprintf("user:%d", id) }
+
+func roomChannel(id string) string { return fmt.Sprintf("room:%s", id) }
+
+func presenceChannel(id uint) string { return fmt.Sprintf("presence:%d", id) }
+
+// Broker carries frames between hub instances. Every hub owns its own broker
+// value; subscriptions made through one broker never affect another.
+type Broker interface {
+	// Publish sends payload to every subscriber of channel.
+	Publish(ctx context.Context, channel string, payload []byte) error
+	// Subscribe registers handler for channel. Subscribing twice to the same
+	// channel is a no-op.
+	Subscribe(channel string, handler func(channel string, payload []byte)) error
+	// Unsubscribe stops delivery for channel.
+	Unsubscribe(channel string) error
+}
+
+// newInstanceID returns a random id used to tag frames published by a hub.
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("instance id: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// MemoryBus is an in-process bus shared by several MemoryBroker values. It lets
+// multiple hubs in one process route to each other as if they were separate
+// instances behind Redis.
+type MemoryBus struct {
+	mu   sync.RWMutex
+	subs map[string]map[*MemoryBroker]func(string, []byte)
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{subs: make(map[string]map[*MemoryBroker]func(string, []byte))}
+}
+
+// MemoryBroker is a Broker attached to a MemoryBus.
+type MemoryBroker struct {
+	bus *MemoryBus
+}
+
+func NewMemoryBroker(bus *MemoryBus) *MemoryBroker {
+	return &MemoryBroker{bus: bus}
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	b.bus.mu.RLock()
+	handlers := make([]func(string, []byte), 0, len(b.bus.subs[channel]))
+	for _, fn := range b.bus.subs[channel] {
+		handlers = append(handlers, fn)
+	}
+	b.bus.mu.RUnlock()
+	for _, fn := range handlers {
+		fn(channel, payload)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(channel string, handler func(string, []byte)) error {
+	b.bus.mu.Lock()
+	defer b.bus.mu.Unlock()
+	set, ok := b.bus.subs[channel]
+	if !ok {
+		set = make(map[*MemoryBroker]func(string, []byte))
+		b.bus.subs[channel] = set
+	}
+	if _, ok := set[b]; !ok {
+		set[b] = handler
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Unsubscribe(channel string) error {
+	b.bus.mu.Lock()
+	defer b.bus.mu.Unlock()
+	if set, ok := b.bus.subs[channel]; ok {
+		delete(set, b)
+		if len(set) == 0 {
+			delete(b.bus.subs, channel)
+		}
+	}
+	return nil
+}
+
+// RedisBroker fans frames out over Redis pub/sub. Delivery is fire-and-forget:
+// instances that are not subscribed at publish time never see the frame. Use
+// StreamBroker when frames must survive restarts.
+type RedisBroker struct {
+	client *redis.Client
+
+	mu   sync.Mutex
+	subs map[string]context.CancelFunc
+}
+
+func NewRedisBroker(client *redis.Client) *RedisBroker {
+	return &RedisBroker{client: client, subs: make(map[string]context.CancelFunc)}
+}
+
+func (b *RedisBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	return b.client.Publish(ctx, channel, payload).Err()
+}
+
+func (b *RedisBroker) Subscribe(channel string, handler func(string, []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[channel]; ok {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pubsub := b.client.Subscribe(ctx, channel)
+	b.subs[channel] = cancel
+	ch := pubsub.Channel()
+	go func() {
+		defer pubsub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				handler(msg.Channel, []byte(msg.Payload))
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *RedisBroker) Unsubscribe(channel string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cancel, ok := b.subs[channel]; ok {
+		cancel()
+		delete(b.subs, channel)
+	}
+	return nil
+}
+
+// Tuning for StreamBroker.
+const (
+	// Longest a blocking XREADGROUP waits before checking for cancellation.
+	streamBlock = 5 * time.Second
+
+	// Entries read per XREADGROUP/XAUTOCLAIM call.
+	streamBatch = 64
+
+	// Pending entries idle for longer than this are claimed by a subscriber,
+	// covering consumers that died before acking.
+	streamReclaimIdle = 30 * time.Second
+
+	// Entries older than this are acked without delivery when a restarted
+	// instance catches up, so a long outage does not replay stale frames.
+	streamReplayWindow = 10 * time.Minute
+
+	// Default approximate cap on entries kept per stream.
+	DefaultStreamMaxLen = 10000
+)
+
+// StreamBroker fans frames out over Redis Streams. Every instance reads through
+// its own consumer group, so each instance sees every entry, and an entry is
+// acknowledged only once the handler has delivered it locally. Entries still
+// pending from a previous run are replayed when the channel is subscribed
+// again, so an instance that restarts with the same name loses nothing that
+// was published while it was away.
+type StreamBroker struct {
+	client   *redis.Client
+	group    string
+	consumer string
+	maxLen   int64
+
+	mu   sync.Mutex
+	subs map[string]context.CancelFunc
+	// channels unsubscribed by this process; their backlog is skipped on
+	// the next Subscribe because nobody here was waiting for it
+	stopped map[string]bool
+}
+
+// NewStreamBroker creates a broker whose consumer group is named after
+// instance. instance must be stable across restarts for pending entries to be
+// reclaimed, and a fixed set of names must be reused: every new name leaves a
+// consumer group behind on every stream. maxLen caps each stream
+// approximately; zero uses DefaultStreamMaxLen.
+func NewStreamBroker(client *redis.Client, instance string, maxLen int64) *StreamBroker {
+	if maxLen <= 0 {
+		maxLen = DefaultStreamMaxLen
+	}
+	return &StreamBroker{
+		client:   client,
+		group:    "hub:" + instance,
+		consumer: instance,
+		maxLen:   maxLen,
+		subs:     make(map[string]context.CancelFunc),
+		stopped:  make(map[string]bool),
+	}
+}
+
+func streamKey(channel string) string { return "stream:" + channel }
+
+func (b *StreamBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	return b.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamKey(channel),
+		MaxLen: b.maxLen,
+		Approx: true,
+		Values: map[string]interface{}{"payload": payload},
+	}).Err()
+}
+
+func (b *StreamBroker) Subscribe(channel string, handler func(string, []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[channel]; ok {
+		return nil
+	}
+	key := streamKey(channel)
+	// "$" only applies when the group is first created; an existing group
+	// resumes from its last delivered entry.
+	err := b.client.XGroupCreateMkStream(context.Background(), key, b.group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	if b.stopped[channel] {
+		if err := b.client.XGroupSetID(context.Background(), key, b.group, "$").Err(); err != nil {
+			return err
+		}
+		delete(b.stopped, channel)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.subs[channel] = cancel
+	go b.consume(ctx, channel, key, handler)
+	return nil
+}
+
+// Unsubscribe stops reading channel. The consumer group is kept, but entries
+// published after this call are skipped when the channel is subscribed again.
+func (b *StreamBroker) Unsubscribe(channel string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cancel, ok := b.subs[channel]; ok {
+		cancel()
+		delete(b.subs, channel)
+		b.stopped[channel] = true
+	}
+	return nil
+}
+
+func (b *StreamBroker) consume(ctx context.Context, channel, key string, handler func(string, []byte)) {
+	// entries this consumer read but never acked before it stopped
+	b.drainPending(ctx, channel, key, handler)
+	// entries abandoned by other consumers of the group
+	b.reclaim(ctx, channel, key, handler)
+
+	for ctx.Err() == nil {
+		streams, err := b.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    b.group,
+			Consumer: b.consumer,
+			Streams:  []string{key, ">"},
+			Count:    streamBatch,
+			Block:    streamBlock,
+		}).Result()
+		if err != nil {
+			if errors.Is(err, redis.Nil) || ctx.Err() != nil {
+				continue
+			}
+			log.Printf("stream read %s error: %v", key, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, s := range streams {
+			b.handle(ctx, channel, key, s.Messages, handler)
+		}
+	}
+}
+
+func (b *StreamBroker) drainPending(ctx context.Context, channel, key string, handler func(string, []byte)) {
+	start := "0"
+	for ctx.Err() == nil {
+		streams, err := b.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    b.group,
+			Consumer: b.consumer,
+			Streams:  []string{key, start},
+			Count:    streamBatch,
+		}).Result()
+		if err != nil {
+			if !errors.Is(err, redis.Nil) && ctx.Err() == nil {
+				log.Printf("stream pending %s error: %v", key, err)
+			}
+			return
+		}
+		if len(streams) == 0 || len(streams[0].Messages) == 0 {
+			return
+		}
+		msgs := streams[0].Messages
+		b.handle(ctx, channel, key, msgs, handler)
+		start = msgs[len(msgs)-1].ID
+	}
+}
+
+func (b *StreamBroker) reclaim(ctx context.Context, channel, key string, handler func(string, []byte)) {
+	start := "0-0"
+	for ctx.Err() == nil {
+		msgs, next, err := b.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   key,
+			Group:    b.group,
+			Consumer: b.consumer,
+			MinIdle:  streamReclaimIdle,
+			Start:    start,
+			Count:    streamBatch,
+		}).Result()
+		if err != nil {
+			if !errors.Is(err, redis.Nil) && ctx.Err() == nil {
+				log.Printf("stream reclaim %s error: %v", key, err)
+			}
+			return
+		}
+		b.handle(ctx, channel, key, msgs, handler)
+		if next == "" || next == "0-0" {
+			return
+		}
+		start = next
+	}
+}
+
+// handle passes each entry to handler and acks it once handler returns.
+func (b *StreamBroker) handle(ctx context.Context, channel, key string, msgs []redis.XMessage, handler func(string, []byte)) {
+	cutoff := time.Now().Add(-streamReplayWindow).UnixMilli()
+	for _, msg := range msgs {
+		payload, ok := msg.Values["payload"].(string)
+		if ok && streamEntryMillis(msg.ID) >= cutoff {
+			handler(channel, []byte(payload))
+		}
+		// the entry was handled: ack it even if the subscription stopped
+		// meanwhile, or the next one would replay it
+		if err := b.client.XAck(context.Background(), key, b.group, msg.ID).Err(); err != nil {
+			log.Printf("stream ack %s %s error: %v", key, msg.ID, err)
+		}
+	}
+}
+
+// streamEntryMillis returns the creation time encoded in a stream entry id.
+func streamEntryMillis(id string) int64 {
+	ms, _, _ := strings.Cut(id, "-")
+	v, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
@@ -0,0 +1,397 @@
+package ws
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// fakeStreams is a Redis server that knows just the stream commands the
+// StreamBroker sends.
+type fakeStreams struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	lastMs  int64
+	lastSeq int64
+	streams map[string]*fakeStream
+}
+
+type fakeStream struct {
+	entries []fakeEntry
+	groups  map[string]*fakeGroup
+}
+
+type fakeEntry struct {
+	id      string
+	payload string
+}
+
+type fakeGroup struct {
+	lastDelivered string
+	// id -> consumer and delivery time of unacked entries
+	pending map[string]fakePending
+}
+
+type fakePending struct {
+	consumer  string
+	delivered time.Time
+}
+
+// newFakeStreams starts a fake server and returns a client connected to it.
+func newFakeStreams(t *testing.T) (*fakeStreams, *redis.Client) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeStreams{streams: make(map[string]*fakeStream)}
+	f.changed = sync.NewCond(&f.mu)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	client := redis.NewClient(&redis.Options{Addr: ln.Addr().String()})
+	t.Cleanup(func() {
+		client.Close()
+		ln.Close()
+	})
+	return f, client
+}
+
+func (f *fakeStreams) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, f.exec(args)); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads one RESP array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func bulk(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+
+func array(items ...string) string {
+	return fmt.Sprintf("*%d\r\n", len(items)) + strings.Join(items, "")
+}
+
+func entryReply(e fakeEntry) string {
+	return array(bulk(e.id), array(bulk("payload"), bulk(e.payload)))
+}
+
+// idLess compares stream entry ids.
+func idLess(a, b string) bool {
+	ams, aseq, _ := strings.Cut(a, "-")
+	bms, bseq, _ := strings.Cut(b, "-")
+	am, _ := strconv.ParseInt(ams, 10, 64)
+	bm, _ := strconv.ParseInt(bms, 10, 64)
+	if am != bm {
+		return am < bm
+	}
+	as, _ := strconv.ParseInt(aseq, 10, 64)
+	bs, _ := strconv.ParseInt(bseq, 10, 64)
+	return as < bs
+}
+
+func (f *fakeStreams) stream(key string) *fakeStream {
+	s, ok := f.streams[key]
+	if !ok {
+		s = &fakeStream{groups: make(map[string]*fakeGroup)}
+		f.streams[key] = s
+	}
+	return s
+}
+
+func (s *fakeStream) lastID() string {
+	if len(s.entries) == 0 {
+		return "0-0"
+	}
+	return s.entries[len(s.entries)-1].id
+}
+
+func (f *fakeStreams) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch strings.ToLower(args[0]) {
+	case "xadd":
+		// the entry id is always "*"; the payload follows it
+		i := 2
+		for args[i] != "*" {
+			i++
+		}
+		ms := time.Now().UnixMilli()
+		if ms <= f.lastMs {
+			ms, f.lastSeq = f.lastMs, f.lastSeq+1
+		} else {
+			f.lastSeq = 0
+		}
+		f.lastMs = ms
+		e := fakeEntry{id: fmt.Sprintf("%d-%d", ms, f.lastSeq), payload: args[i+2]}
+		s := f.stream(args[1])
+		s.entries = append(s.entries, e)
+		f.changed.Broadcast()
+		return bulk(e.id)
+	case "xgroup":
+		s := f.stream(args[2])
+		switch strings.ToLower(args[1]) {
+		case "create":
+			if _, ok := s.groups[args[3]]; ok {
+				return "-BUSYGROUP Consumer Group name already exists\r\n"
+			}
+			s.groups[args[3]] = &fakeGroup{lastDelivered: s.lastID(), pending: make(map[string]fakePending)}
+		case "setid":
+			s.groups[args[3]].lastDelivered = s.lastID()
+		}
+		return "+OK\r\n"
+	case "xreadgroup":
+		return f.readGroup(args)
+	case "xack":
+		if s, ok := f.streams[args[1]]; ok {
+			if g, ok := s.groups[args[2]]; ok {
+				for _, id := range args[3:] {
+					delete(g.pending, id)
+				}
+			}
+		}
+		return ":1\r\n"
+	case "xautoclaim":
+		s, g := f.streams[args[1]], f.streams[args[1]].groups[args[2]]
+		minIdle, _ := strconv.Atoi(args[4])
+		var claimed []string
+		for _, e := range s.entries {
+			p, ok := g.pending[e.id]
+			if ok && time.Since(p.delivered) >= time.Duration(minIdle)*time.Millisecond {
+				g.pending[e.id] = fakePending{consumer: args[3], delivered: time.Now()}
+				claimed = append(claimed, entryReply(e))
+			}
+		}
+		return array(bulk("0-0"), array(claimed...))
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// readGroup serves XREADGROUP GROUP g c [COUNT n] [BLOCK ms] STREAMS key id.
+// Blocking reads wait at most 50ms so stopped consumers notice quickly.
+func (f *fakeStreams) readGroup(args []string) string {
+	group, consumer := args[2], args[3]
+	block := false
+	var key, start string
+	for i := 4; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "block":
+			block = true
+		case "streams":
+			key, start = args[i+1], args[i+2]
+		}
+	}
+	s := f.stream(key)
+	g, ok := s.groups[group]
+	if !ok {
+		return "-NOGROUP No such key or consumer group\r\n"
+	}
+	if start != ">" {
+		// this consumer's pending entries after start
+		var ids []string
+		for id, p := range g.pending {
+			if p.consumer == consumer && idLess(start, id) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool { return idLess(ids[i], ids[j]) })
+		var items []string
+		for _, e := range s.entries {
+			for _, id := range ids {
+				if e.id == id {
+					items = append(items, entryReply(e))
+				}
+			}
+		}
+		return array(array(bulk(key), array(items...)))
+	}
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for {
+		var items []string
+		for _, e := range s.entries {
+			if idLess(g.lastDelivered, e.id) {
+				g.lastDelivered = e.id
+				g.pending[e.id] = fakePending{consumer: consumer, delivered: time.Now()}
+				items = append(items, entryReply(e))
+			}
+		}
+		if len(items) > 0 {
+			return array(array(bulk(key), array(items...)))
+		}
+		if !block || time.Now().After(deadline) {
+			return "*-1\r\n"
+		}
+		// wake up on new entries or at the deadline
+		timer := time.AfterFunc(time.Until(deadline), func() {
+			f.mu.Lock()
+			f.changed.Broadcast()
+			f.mu.Unlock()
+		})
+		f.changed.Wait()
+		timer.Stop()
+	}
+}
+
+// pendingCount returns the unacked entries of group on channel.
+func (f *fakeStreams) pendingCount(channel, group string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.stream(streamKey(channel)).groups[group].pending)
+}
+
+// collect returns a handler that sends payloads to the returned channel.
+func collect() (func(string, []byte), chan string) {
+	ch := make(chan string, 16)
+	return func(_ string, payload []byte) { ch <- string(payload) }, ch
+}
+
+func expectPayload(t *testing.T, ch chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("expected payload '%s', got '%s'", want, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for '%s'", want)
+	}
+}
+
+func expectNoPayload(t *testing.T, ch chan string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		t.Fatalf("unexpected payload '%s'", got)
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func TestStreamBrokerFansOutToEveryInstance(t *testing.T) {
+	fake, client := newFakeStreams(t)
+	a := NewStreamBroker(client, "a", 0)
+	b := NewStreamBroker(client, "b", 0)
+	ha, cha := collect()
+	hb, chb := collect()
+	if err := a.Subscribe("user:1", ha); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Subscribe("user:1", hb); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Unsubscribe("user:1")
+	defer b.Unsubscribe("user:1")
+
+	if err := a.Publish(client.Context(), "user:1", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	expectPayload(t, cha, "hello")
+	expectPayload(t, chb, "hello")
+	expectNoPayload(t, cha)
+	if n := fake.pendingCount("user:1", "hub:a"); n != 0 {
+		t.Fatalf("pending entries = %d, want 0", n)
+	}
+}
+
+func TestStreamBrokerReplaysAfterRestart(t *testing.T) {
+	_, client := newFakeStreams(t)
+	h, ch := collect()
+	first := NewStreamBroker(client, "a", 0)
+	if err := first.Subscribe("room:7", h); err != nil {
+		t.Fatal(err)
+	}
+	first.Unsubscribe("room:7")
+	// let the stopped consumer finish its blocking read
+	time.Sleep(100 * time.Millisecond)
+
+	// published while the instance is down
+	other := NewStreamBroker(client, "b", 0)
+	if err := other.Publish(client.Context(), "room:7", []byte("missed")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the instance restarts under the same name
+	restarted := NewStreamBroker(client, "a", 0)
+	if err := restarted.Subscribe("room:7", h); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Unsubscribe("room:7")
+	expectPayload(t, ch, "missed")
+}
+
+func TestStreamBrokerResubscribeSkipsBacklog(t *testing.T) {
+	_, client := newFakeStreams(t)
+	h, ch := collect()
+	b := NewStreamBroker(client, "a", 0)
+	if err := b.Subscribe("user:2", h); err != nil {
+		t.Fatal(err)
+	}
+	b.Unsubscribe("user:2")
+	time.Sleep(100 * time.Millisecond)
+
+	// nobody on this instance was waiting for it
+	if err := b.Publish(client.Context(), "user:2", []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Subscribe("user:2", h); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Unsubscribe("user:2")
+	expectNoPayload(t, ch)
+
+	if err := b.Publish(client.Context(), "user:2", []byte("fresh")); err != nil {
+		t.Fatal(err)
+	}
+	expectPayload(t, ch, "fresh")
+}
@@ -1,6 +1,7 @@
 package ws
 
 import (
+	"errors"
 	"log"
 	"time"
 
@@ -11,6 +12,9 @@ import (
 )
 
 const (
+	// Longest client_msg_id accepted.
+	maxClientMsgID = 64
+
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
 
@@ -29,6 +33,118 @@ type Message struct {
 	RoomID string `json:"room_id,omitempty"`
 	ID     uint   `json:"id,omitempty"`
 	Body   string `json:"body"`
+	// Per-user outbound sequence, set by the hub on delivery.
+	Seq uint64 `json:"seq,omitempty"`
+	// Sender-chosen id that makes retried sends idempotent.
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	// "add" or "remove" for reaction frames.
+	Action string `json:"action,omitempty"`
+	// Message answered by this one and the root of its thread.
+	ReplyTo    uint `json:"reply_to,omitempty"`
+	ThreadRoot uint `json:"thread_root,omitempty"`
+}
+
+// serverTypes are frame types only the server sends; clients may not.
+var serverTypes = map[string]bool{
+	"sent":   true,
+	"error":  true,
+	"resync": true,
+
+	// membership changes; addressed to a user even though they name a room
+	"room_joined": true,
+	"room_left":   true,
+
+	// status changes of a watched user
+	"presence": true,
+
+	// contact requests and acceptances, pushed from the REST endpoints
+	"friend_request": true,
+	"friend_accept":  true,
+
+	// internal: From and the recipient blocked or unblocked each other;
+	// unwatched also ends the recipient's watches of From. Never delivered.
+	"unwatched": true,
+	"unblocked": true,
+
+	// the recipient's tokens were revoked; their connections close after
+	// it. Body names the session whose connections close, empty for all.
+	"logout": true,
+}
+
+// controlTypes are client frame types that carry protocol state rather than
+// a stored chat message, even when their ID refers to one.
+var controlTypes = map[string]bool{
+	"join":  true,
+	"leave": true,
+	"ack":   true,
+	"read":  true,
+
+	// changes to a stored message; ID names the message, not a new one
+	"edit":   true,
+	"delete": true,
+
+	// emoji reactions; Body is the emoji and ID the message reacted to
+	"reaction": true,
+
+	// presence: set own status, start or stop watching another user
+	"status":  true,
+	"watch":   true,
+	"unwatch": true,
+
+	// typing indicators; routed like messages but never stored
+	"typing_start": true,
+	"typing_stop":  true,
+}
+
+// ephemeralTypes are frames that only matter while they are fresh. They
+// carry no sequence number and are not kept for resuming.
+var ephemeralTypes = map[string]bool{
+	"presence":     true,
+	"typing_start": true,
+	"typing_stop":  true,
+
+	// closes connections; replaying it would close a resuming one
+	"logout": true,
+}
+
+// wellFormed reports whether control frame m names what it acts on: a room
+// to join or leave, a user to watch or a conversation to type in, or the
+// message it changes, reacts to or acknowledges.
+func wellFormed(m *Message) bool {
+	switch m.Type {
+	case "join", "leave":
+		return m.RoomID != ""
+	case "watch", "unwatch":
+		return m.To != 0
+	case "typing_start", "typing_stop":
+		return m.To != 0 || m.RoomID != ""
+	case "edit", "delete", "reaction", "ack", "read":
+		return m.ID != 0
+	}
+	return true
+}
+
+// isStored reports whether m is a persisted chat message.
+func isStored(m *Message) bool {
+	return m.ID != 0 && !controlTypes[m.Type] && !serverTypes[m.Type]
+}
+
+// messageFromModel converts a stored message into a wire frame.
+func messageFromModel(m *model.Message) *Message {
+	msg := &Message{
+		Type:       m.Type,
+		From:       m.From,
+		To:         m.To,
+		RoomID:     m.Room,
+		ID:         m.ID,
+		Body:       m.Body,
+		ReplyTo:    m.ReplyTo,
+		ThreadRoot: m.ThreadRoot,
+	}
+	if m.ClientMsgID != nil {
+		msg.ClientMsgID = *m.ClientMsgID
+	}
+	return msg
 }
 
 // Client is a middleman between the websocket connection and the hub.
@@ -43,14 +159,54 @@ type Client struct {
 
 	// user id associated with this connection
 	userID uint
+
+	// connID names this connection in the user's presence entries.
+	connID string
+
+	// sid is the login session of the token the client connected with.
+	sid string
+
+	// Rooms this client has joined. Only touched by the hub goroutine.
+	rooms map[string]bool
+
+	// Users whose presence this client watches. Only touched by the hub
+	// goroutine.
+	watching map[uint]bool
+
+	// Set by the hub once the client is unregistered.
+	gone bool
+
+	// Last sequence number the client saw before reconnecting.
+	resumeFrom uint64
+
+	// Persisted rooms joined when the client registers.
+	autoRooms []string
+
+	// Frames held back while a resume gap is loaded; nil when not resuming.
+	held []*Message
 }
 
 func NewClient(h *Hub, conn *websocket.Conn, userID uint) *Client {
 	return &Client{
-		hub:    h,
-		conn:   conn,
-		send:   make(chan *Message, 256),
-		userID: userID,
+		hub:      h,
+		conn:     conn,
+		send:     make(chan *Message, 256),
+		userID:   userID,
+		connID:   newInstanceID(),
+		rooms:    make(map[string]bool),
+		watching: make(map[uint]bool),
+	}
+}
+
+// presenceChanged pushes the status of c's user to its watchers when a
+// presence update changed it.
+func (c *Client) presenceChanged(status string, changed bool, err error) {
+	if err != nil {
+		log.Printf("presence update for user %d: %v", c.userID, err)
+		return
+	}
+	if changed {
+		c.hub.Dispatch(&Message{Type: "presence", From: c.userID, Body: status})
 	}
 }
 
@@ -58,12 +214,15 @@ func (c *Client) ReadPump() {
 	defer func() {
 		c.hub.unregister <- c
 		c.conn.Close()
+		c.stopTyping()
+		c.presenceChanged(service.DisconnectPresence(c.userID, c.connID))
 	}()
 	c.conn.SetReadLimit(512)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		log.Printf("pong received from user %d", c.userID)
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.presenceChanged(service.RefreshPresence(c.userID, c.connID))
 		return nil
 	})
 	for {
@@ -76,39 +235,228 @@ func (c *Client) ReadPump() {
 		}
 		// set sender
 		msg.From = c.userID
+		msg.Seq = 0
+		msg.ThreadRoot = 0
+		if serverTypes[msg.Type] {
+			c.hub.reply(c, &Message{Type: "error", Body: "frame type not allowed: " + msg.Type})
+			continue
+		}
+		// a control frame missing what it refers to is answered, never
+		// stored as a chat message
+		if controlTypes[msg.Type] && !wellFormed(&msg) {
+			c.hub.reply(c, &Message{Type: "error", Body: "malformed frame: " + msg.Type})
+			continue
+		}
 
-		// handle join/leave room messages
-		if msg.Type == "join" && msg.RoomID != "" {
-			c.hub.joinRoom(msg.RoomID, c)
+		// handle join/leave room messages; joining requires membership
+		if msg.Type == "join" {
+			if err := service.CheckRoomMember(msg.RoomID, c.userID); err != nil {
+				c.hub.reply(c, &Message{Type: "error", RoomID: msg.RoomID, Body: err.Error()})
+				continue
+			}
+			c.hub.roomOps <- roomOp{client: c, roomID: msg.RoomID, join: true}
 			continue
 		}
-		if msg.Type == "leave" && msg.RoomID != "" {
-			c.hub.leaveRoom(msg.RoomID, c)
+		if msg.Type == "leave" {
+			c.hub.roomOps <- roomOp{client: c, roomID: msg.RoomID}
+			continue
+		}
+
+		// handle presence: a client marks itself away or back, and watches
+		// other users to be told when their status changes
+		if msg.Type == "status" {
+			if msg.Body != service.PresenceAway && msg.Body != service.PresenceOnline {
+				c.hub.reply(c, &Message{Type: "error", Body: "invalid status: " + msg.Body})
+				continue
+			}
+			c.presenceChanged(service.SetPresenceAway(c.userID, c.connID, msg.Body == service.PresenceAway))
+			continue
+		}
+		if msg.Type == "unwatch" {
+			c.hub.watchOps <- watchOp{client: c, userID: msg.To}
+			continue
+		}
+		if msg.Type == "watch" {
+			if err := service.CheckWatch(c.userID, msg.To); err != nil {
+				c.hub.reply(c, &Message{Type: "error", To: msg.To, Body: err.Error()})
+				continue
+			}
+			p, err := service.GetPresence(c.userID, msg.To)
+			if err != nil {
+				c.hub.reply(c, &Message{Type: "error", To: msg.To, Body: err.Error()})
+				continue
+			}
+			// users blocked either way look offline and are not watched
+			if !blocked(c.userID, msg.To) {
+				c.hub.watchOps <- watchOp{client: c, userID: msg.To, watch: true}
+			}
+			c.hub.reply(c, &Message{Type: "presence", From: msg.To, Body: p.Status})
+			continue
+		}
+
+		if msg.Type == "typing_start" || msg.Type == "typing_stop" {
+			c.typing(&msg)
+			continue
+		}
+
+		// handle edits and deletes of the sender's own messages
+		if msg.Type == "edit" || msg.Type == "delete" {
+			var changed *model.Message
+			var err error
+			if msg.Type == "edit" {
+				changed, err = service.EditMessage(c.userID, msg.ID, msg.Body)
+			} else {
+				changed, err = service.DeleteMessage(c.userID, msg.ID)
+			}
+			if err != nil {
+				c.hub.reply(c, &Message{Type: "error", ID: msg.ID, Body: err.Error()})
+				continue
+			}
+			c.hub.DispatchChange(msg.Type, changed)
+			continue
+		}
+
+		// handle reactions to any message the client can see
+		if msg.Type == "reaction" {
+			var m *model.Message
+			var changed bool
+			var err error
+			switch msg.Action {
+			case "add":
+				m, changed, err = service.AddReaction(c.userID, msg.ID, msg.Body)
+			case "remove":
+				m, changed, err = service.RemoveReaction(c.userID, msg.ID, msg.Body)
+			default:
+				err = errors.New("invalid reaction action: " + msg.Action)
+			}
+			if err != nil {
+				c.hub.reply(c, &Message{Type: "error", ID: msg.ID, Body: err.Error()})
+				continue
+			}
+			if changed {
+				c.hub.DispatchReaction(m, c.userID, msg.Body, msg.Action)
+			}
 			continue
 		}
 
 		// handle ack messages
-		if msg.Type == "ack" && msg.ID != 0 {
-			// mark message delivered
-			if err := service.AckMessage(msg.ID); err != nil {
+		if msg.Type == "ack" {
+			// mark message delivered and tell the sender, unless it was
+			// already delivered while this client was online
+			acked, err := service.AckMessageFor(msg.ID, c.userID)
+			if err != nil {
 				log.Printf("ack update failed: %v", err)
+			} else if acked != nil {
+				c.hub.broadcast <- &Message{Type: "ack", ID: acked.ID, To: acked.From}
+			}
+			continue
+		}
+
+		// handle read receipts: move the reader's watermark and tell the
+		// other side of the conversation and the reader's other devices
+		if msg.Type == "read" {
+			marker, err := service.MarkRead(c.userID, msg.ID)
+			if err != nil {
+				c.hub.reply(c, &Message{Type: "error", ID: msg.ID, Body: err.Error()})
+				continue
+			}
+			if marker == nil {
+				continue
+			}
+			if marker.Room != "" {
+				c.hub.broadcast <- &Message{Type: "read", From: c.userID, RoomID: marker.Room, ID: marker.LastReadID}
+				continue
+			}
+			c.hub.broadcast <- &Message{Type: "read", From: c.userID, To: marker.PeerID, ID: marker.LastReadID}
+			if marker.PeerID != c.userID {
+				c.hub.broadcast <- &Message{Type: "read", From: c.userID, To: c.userID, ID: marker.LastReadID}
 			}
 			continue
 		}
 
+		if len(msg.ClientMsgID) > maxClientMsgID {
+			c.hub.reply(c, &Message{Type: "error", ClientMsgID: msg.ClientMsgID, Body: "client_msg_id too long"})
+			continue
+		}
+
+		if msg.RoomID != "" {
+			if err := service.CheckRoomMember(msg.RoomID, c.userID); err != nil {
+				c.hub.reply(c, &Message{Type: "error", RoomID: msg.RoomID, ClientMsgID: msg.ClientMsgID, Body: err.Error()})
+				continue
+			}
+		}
+
+		if msg.RoomID == "" && msg.To != 0 {
+			if err := service.CheckDirectMessage(c.userID, msg.To); err != nil {
+				c.hub.reply(c, &Message{Type: "error", To: msg.To, ClientMsgID: msg.ClientMsgID, Body: err.Error()})
+				continue
+			}
+		}
+
+		if msg.ClientMsgID != "" {
+			// a retry of a message we already have: confirm it again but
+			// do not deliver it twice, before checks such as the
+			// attachment's that the first attempt changed the outcome of
+			existing, err := service.FindClientMessage(c.userID, msg.ClientMsgID)
+			if err != nil {
+				log.Printf("find message by client_msg_id failed: %v", err)
+			} else if existing != nil {
+				c.hub.reply(c, &Message{Type: "sent", ID: existing.ID, ClientMsgID: msg.ClientMsgID})
+				continue
+			}
+		}
+
+		// attachment messages reference an uploaded file in a structured
+		// body, which the server completes with the file's metadata
+		var attachmentID uint
+		if msg.Type == "attachment" {
+			body, id, err := service.PrepareAttachmentBody(c.userID, msg.Body)
+			if err != nil {
+				c.hub.reply(c, &Message{Type: "error", ClientMsgID: msg.ClientMsgID, Body: err.Error()})
+				continue
+			}
+			msg.Body, attachmentID = body, id
+		}
+
 		// persist message to DB
 		mm := &model.Message{
-			From: msg.From,
-			To:   msg.To,
-			Room: msg.RoomID,
-			Type: msg.Type,
-			Body: msg.Body,
+			From:    msg.From,
+			To:      msg.To,
+			Room:    msg.RoomID,
+			Type:    msg.Type,
+			Body:    msg.Body,
+			ReplyTo: msg.ReplyTo,
+		}
+		if msg.ClientMsgID != "" {
+			mm.ClientMsgID = &msg.ClientMsgID
+		}
+		err := service.SaveAttachmentMessage(mm, attachmentID)
+		if errors.Is(err, service.ErrDuplicateMessage) {
+			// a retry of a message we already have: confirm it again but
+			// do not deliver it twice
+			c.hub.reply(c, &Message{Type: "sent", ID: mm.ID, ClientMsgID: msg.ClientMsgID})
+			continue
 		}
-		if err := service.SaveMessage(mm); err != nil {
+		if errors.Is(err, service.ErrInvalidReply) {
+			c.hub.reply(c, &Message{Type: "error", ClientMsgID: msg.ClientMsgID, ReplyTo: msg.ReplyTo, Body: err.Error()})
+			continue
+		}
+		if errors.Is(err, service.ErrAttachmentUsed) {
+			c.hub.reply(c, &Message{Type: "error", ClientMsgID: msg.ClientMsgID, Body: err.Error()})
+			continue
+		}
+		if err != nil {
 			log.Printf("save message failed: %v", err)
 		} else {
 			// set generated ID so receivers can ack
 			msg.ID = mm.ID
+			msg.ThreadRoot = mm.ThreadRoot
+			if err := service.TouchConversations(mm); err != nil {
+				log.Printf("update conversations failed: %v", err)
+			}
+			if msg.ClientMsgID != "" {
+				c.hub.reply(c, &Message{Type: "sent", ID: mm.ID, ClientMsgID: msg.ClientMsgID})
+			}
 		}
 
 		c.hub.broadcast <- &msg
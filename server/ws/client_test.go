@@ -0,0 +1,28 @@
+package ws
+
+import "testing"
+
+func TestWellFormedControlFrames(t *testing.T) {
+	for _, tc := range []struct {
+		m    Message
+		want bool
+	}{
+		{Message{Type: "join"}, false},
+		{Message{Type: "join", RoomID: "7"}, true},
+		{Message{Type: "leave", To: 5}, false},
+		{Message{Type: "watch", RoomID: "7"}, false},
+		{Message{Type: "unwatch", To: 5}, true},
+		{Message{Type: "typing_start"}, false},
+		{Message{Type: "typing_stop", RoomID: "7"}, true},
+		{Message{Type: "edit", To: 5, Body: "x"}, false},
+		{Message{Type: "edit", ID: 3, Body: "x"}, true},
+		{Message{Type: "reaction", Body: "👍", Action: "add"}, false},
+		{Message{Type: "ack"}, false},
+		{Message{Type: "read", ID: 3}, true},
+		{Message{Type: "status", Body: "away"}, true},
+	} {
+		if got := wellFormed(&tc.m); got != tc.want {
+			t.Fatalf("wellFormed(%+v) = %v, want %v", tc.m, got, tc.want)
+		}
+	}
+}
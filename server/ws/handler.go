@@ -1,6 +1,7 @@
 package ws
 
 import (
+	"log"
 	"net/http"
 	"strconv"
 
@@ -13,35 +14,34 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
-// ServeWS handles websocket requests from the peer.
-// Expects a query parameter `user_id` (uint). JWT/auth integration will be added later.
+// ServeWS handles websocket requests from the peer. The JWT comes from the
+// Authorization header or the `token` query parameter; tokens of suspended
+// accounts, revoked tokens and tokens of ended sessions are refused.
+// A reconnecting client passes `resume_from` with the last `seq` it received
+// to have the frames it missed replayed.
 func ServeWS(w http.ResponseWriter, r *http.Request) {
-	// Try to authenticate via JWT token from Authorization header or "token" query
 	token := r.Header.Get("Authorization")
 	if token == "" {
 		token = r.URL.Query().Get("token")
 	}
-	var userID uint
-	if token != "" {
-		user, err := service.AuthenticateToken(token)
-		if err != nil {
-			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
-			return
-		}
-		userID = user.ID
-	} else {
-		// fallback to user_id query for development
-		userStr := r.URL.Query().Get("user_id")
-		if userStr == "" {
-			http.Error(w, "user_id or token required", http.StatusBadRequest)
-			return
-		}
-		uid64, err := strconv.ParseUint(userStr, 10, 64)
+	if token == "" {
+		http.Error(w, "token required", http.StatusUnauthorized)
+		return
+	}
+	user, sid, err := service.AuthenticateToken(token)
+	if err != nil {
+		http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	userID := user.ID
+	var resumeFrom uint64
+	if rs := r.URL.Query().Get("resume_from"); rs != "" {
+		v, err := strconv.ParseUint(rs, 10, 64)
 		if err != nil {
-			http.Error(w, "invalid user_id", http.StatusBadRequest)
+			http.Error(w, "invalid resume_from", http.StatusBadRequest)
 			return
 		}
-		userID = uint(uid64)
+		resumeFrom = v
 	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -49,7 +49,15 @@ func ServeWS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := NewClient(DefaultHub, conn, userID)
+	client.sid = sid
+	client.resumeFrom = resumeFrom
+	if rooms, err := service.ListUserRoomIDs(userID); err != nil {
+		log.Printf("load rooms for user %d: %v", userID, err)
+	} else {
+		client.autoRooms = rooms
+	}
 	DefaultHub.register <- client
+	client.presenceChanged(service.ConnectPresence(userID, client.connID))
 	go client.WritePump()
 	client.ReadPump()
 }
@@ -2,19 +2,25 @@ package ws
 
 import (
 	"chat/global"
+	"chat/model"
 	"chat/service"
 	"context"
 	"encoding/json"
-	"fmt"
 	"log"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
+// Number of undelivered messages loaded per query when replaying.
+const offlineBatch = 100
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
+	// id tags frames this hub publishes so it can skip its own echoes.
+	id string
+
 	// Registered clients.
 	clients map[*Client]bool
 
@@ -24,6 +30,9 @@ type Hub struct {
 	// Map roomID -> set of clients
 	rooms map[string]map[*Client]bool
 
+	// Map userID -> set of clients watching that user's presence
+	watchers map[uint]map[*Client]bool
+
 	// Inbound messages from the clients.
 	broadcast chan *Message
 
@@ -33,300 +42,622 @@ type Hub struct {
 	// Unregister requests from clients.
 	unregister chan *Client
 
-	// Redis pubsub subscriptions per channel
-	subs   map[string]*RedisSub
-	subsMu sync.Mutex
+	// Join/leave requests from clients.
+	roomOps chan roomOp
+
+	// Watch/unwatch presence requests from clients.
+	watchOps chan watchOp
+
+	// Frames received from other instances through the broker.
+	remote chan *envelope
+
+	// Frames for a single client: replays and replies to its own requests.
+	unicast chan clientBatch
+
+	// Cross-instance transport; nil keeps the hub local only.
+	broker Broker
+
+	// Broker channels this hub is subscribed to. Only touched from Run.
+	subs map[string]bool
+
+	// Outbound sequence and resume buffer per user. Only touched from Run.
+	sessions map[uint]*session
+
+	// Map roomID -> users without local clients whose idle session still
+	// records the room's frames. Only touched from Run.
+	idle map[string]map[uint]bool
+
+	// Block checks of frames from other instances.
+	blocks *blockCache
+
+	// Typing indicators of this hub's clients, by sender and conversation.
+	typing *typingStates
+
+	// Reads the direct messages a user has not acked yet, for replay on
+	// connect.
+	undelivered func(userID, afterID uint, limit int) ([]model.Message, error)
+}
+
+// envelope wraps a frame published to the broker.
+type envelope struct {
+	Origin  string   `json:"origin"`
+	Channel string   `json:"-"`
+	Msg     *Message `json:"msg"`
+
+	// closed by Run once the frame has been handed to local clients
+	done chan struct{}
+}
+
+// clientBatch carries frames for a single client.
+type clientBatch struct {
+	client *Client
+	msgs   []*Message
+	// msgs fill a resume gap: they already carry sequence numbers and the
+	// frames held back while loading them are sent afterwards
+	release bool
 }
 
-func NewHub() *Hub {
+type roomOp struct {
+	client *Client
+	roomID string
+	join   bool
+}
+
+type watchOp struct {
+	client *Client
+	userID uint
+	watch  bool
+}
+
+// NewHub creates a hub that fans out through b. A nil broker keeps delivery
+// within this process.
+func NewHub(b Broker) *Hub {
 	return &Hub{
+		id:         newInstanceID(),
 		broadcast:  make(chan *Message, 256),
 		register:   make(chan *Client, 128),
 		unregister: make(chan *Client, 128),
+		roomOps:    make(chan roomOp, 128),
+		watchOps:   make(chan watchOp, 128),
+		remote:     make(chan *envelope, 256),
+		unicast:    make(chan clientBatch, 128),
+		broker:     b,
 		clients:    make(map[*Client]bool),
 		users:      make(map[uint]map[*Client]bool),
 		rooms:      make(map[string]map[*Client]bool),
-		subs:       make(map[string]*RedisSub),
+		watchers:   make(map[uint]map[*Client]bool),
+		subs:       make(map[string]bool),
+		sessions:   make(map[uint]*session),
+		idle:       make(map[string]map[uint]bool),
+		blocks:     newBlockCache(),
+		typing:     newTypingStates(),
+
+		undelivered: undeliveredMessages,
 	}
 }
 
-// DefaultHub is the package-level hub used by the server.
-var DefaultHub = NewHub()
+// DefaultHub is the package-level hub used by the server. It is created by
+// initialize.InitHub once Redis is available.
+var DefaultHub *Hub
 
 func (h *Hub) Run() {
+	h.ensureSub(broadcastChannel)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
 	for {
 		select {
 		case c := <-h.register:
+			if c.gone {
+				// unregistered before its register request was handled
+				continue
+			}
 			h.clients[c] = true
 			if c.userID != 0 {
 				if _, ok := h.users[c.userID]; !ok {
 					h.users[c.userID] = make(map[*Client]bool)
 				}
 				h.users[c.userID][c] = true
-				// ensure redis subscription for user channel
-				h.ensureSub(fmt.Sprintf("user:%d", c.userID))
+				// ensure broker subscription for user channel
+				h.ensureSub(userChannel(c.userID))
+				h.unpark(c.userID)
+				for _, roomID := range c.autoRooms {
+					h.joinRoom(roomID, c)
+				}
+				var replayed map[uint]bool
+				if c.resumeFrom > 0 {
+					replayed = h.resume(c)
+				}
+				go h.loadOffline(c, replayed)
 			}
 			log.Printf("client registered: user=%d total=%d", c.userID, len(h.clients))
 		case c := <-h.unregister:
-			if _, ok := h.clients[c]; ok {
-				delete(h.clients, c)
-				close(c.send)
+			h.removeClient(c)
+			log.Printf("client unregistered: user=%d total=%d", c.userID, len(h.clients))
+		case op := <-h.roomOps:
+			if op.join {
+				h.joinRoom(op.roomID, op.client)
+			} else {
+				h.leaveRoom(op.roomID, op.client)
 			}
-			if c.userID != 0 {
-				if set, ok := h.users[c.userID]; ok {
-					delete(set, c)
-					if len(set) == 0 {
-						delete(h.users, c.userID)
-						// remove redis subscription when no local clients
-						h.removeSub(fmt.Sprintf("user:%d", c.userID))
-					}
-				}
+		case op := <-h.watchOps:
+			if op.watch {
+				h.watch(op.userID, op.client)
+			} else {
+				h.unwatch(op.userID, op.client)
 			}
-			log.Printf("client unregistered: user=%d total=%d", c.userID, len(h.clients))
 		case m := <-h.broadcast:
-			// publish to redis so other instances receive
-			go h.publishToRedis(m)
-			if m.RoomID != "" {
-				// broadcast to room
-				if set, ok := h.rooms[m.RoomID]; ok {
-					for c := range set {
-						select {
-						case c.send <- m:
-						default:
-							close(c.send)
-							delete(h.clients, c)
-						}
-					}
-				}
-			} else if m.To != 0 {
-				// targeted to a user
-				deliveredLocal := false
-				if set, ok := h.users[m.To]; ok {
-					for c := range set {
-						select {
-						case c.send <- m:
-							deliveredLocal = true
-						default:
-							close(c.send)
-							delete(h.clients, c)
-						}
-					}
-				}
-				if deliveredLocal {
-					// mark message delivered and notify sender
-					if m.ID != 0 {
-						go func(id uint) {
-							if err := service.AckMessage(id); err != nil {
-								log.Printf("AckMessage error: %v", err)
-							}
-						}(m.ID)
-					}
-					// send ack to sender local clients
-					ack := &Message{Type: "ack", ID: m.ID}
-					if set, ok := h.users[m.From]; ok {
-						for c := range set {
-							select {
-							case c.send <- ack:
-							default:
-								close(c.send)
-								delete(h.clients, c)
-							}
-						}
-					}
-					// publish ack to sender channel so other instances can update
-					if m.From != 0 && global.GVA_REDIS != nil {
-						b, _ := json.Marshal(ack)
-						if err := global.GVA_REDIS.Publish(context.Background(), fmt.Sprintf("user:%d", m.From), string(b)).Err(); err != nil {
-							log.Printf("redis publish ack error: %v", err)
-						}
-					}
-				}
-			} else {
-				// broadcast to all
-				for c := range h.clients {
-					select {
-					case c.send <- m:
-					default:
-						close(c.send)
-						delete(h.clients, c)
-					}
+			h.route(m)
+		case e := <-h.remote:
+			h.deliverRemote(e)
+			close(e.done)
+		case b := <-h.unicast:
+			if b.client.gone {
+				continue
+			}
+			if b.release {
+				h.release(b.client, b.msgs)
+				continue
+			}
+			for _, m := range b.msgs {
+				if !h.send(b.client, h.stamp(b.client.userID, m)) {
+					break
 				}
 			}
+		case now := <-ticker.C:
+			h.expireSessions(now)
+		}
+	}
+}
+
+// Dispatch routes a server-generated frame as if a client had sent it. Safe
+// to call from any goroutine.
+func (h *Hub) Dispatch(m *Message) {
+	if h == nil {
+		return
+	}
+	h.broadcast <- m
+}
+
+// DispatchChange tells every participant of a stored message, including the
+// sender's other devices, that it was edited or deleted. typ is "edit" or
+// "delete".
+func (h *Hub) DispatchChange(typ string, m *model.Message) {
+	h.dispatchAbout(m, &Message{Type: typ, From: m.From, ID: m.ID, Body: m.Body})
+}
+
+// DispatchReaction tells every participant of m that userID added or removed
+// an emoji reaction to it. action is "add" or "remove".
+func (h *Hub) DispatchReaction(m *model.Message, userID uint, emoji, action string) {
+	h.dispatchAbout(m, &Message{Type: "reaction", From: userID, ID: m.ID, Body: emoji, Action: action})
+}
+
+// dispatchAbout sends f to the room of m, or to both sides of a direct m.
+func (h *Hub) dispatchAbout(m *model.Message, f *Message) {
+	if m.Room != "" {
+		f.RoomID = m.Room
+		h.Dispatch(f)
+		return
+	}
+	to := *f
+	to.To = m.To
+	h.Dispatch(&to)
+	if m.To != m.From {
+		from := *f
+		from.To = m.From
+		h.Dispatch(&from)
+	}
+}
+
+// route delivers a frame produced on this instance and publishes it so other
+// instances can deliver it too.
+func (h *Hub) route(m *Message) {
+	if m.Type == "presence" {
+		h.publish(presenceChannel(m.From), m)
+		h.deliverPresence(m.From, m)
+	} else if m.To != 0 && serverTypes[m.Type] {
+		// server notices about a room go to one user, not the room
+		h.publish(userChannel(m.To), m)
+		h.deliverUser(m.To, m)
+	} else if m.RoomID != "" {
+		h.publish(roomChannel(m.RoomID), m)
+		h.deliverRoom(m.RoomID, m)
+	} else if m.To != 0 {
+		h.publish(userChannel(m.To), m)
+		if h.deliverUser(m.To, m) {
+			h.confirm(m)
+		}
+	} else {
+		h.publish(broadcastChannel, m)
+		h.deliverAll(m)
+	}
+}
+
+// deliverRemote delivers a frame received from another instance to the local
+// clients subscribed to its channel.
+func (h *Hub) deliverRemote(e *envelope) {
+	m := e.Msg
+	switch {
+	case strings.HasPrefix(e.Channel, "user:"):
+		uid, err := strconv.ParseUint(strings.TrimPrefix(e.Channel, "user:"), 10, 64)
+		if err != nil {
+			return
+		}
+		if h.deliverUser(uint(uid), m) && isStored(m) {
+			h.confirm(m)
+		}
+	case strings.HasPrefix(e.Channel, "room:"):
+		h.deliverRoom(strings.TrimPrefix(e.Channel, "room:"), m)
+	case strings.HasPrefix(e.Channel, "presence:"):
+		h.deliverPresence(m.From, m)
+	default:
+		h.deliverAll(m)
+	}
+}
+
+// confirm marks a direct message delivered and acks its sender on every
+// instance.
+func (h *Hub) confirm(m *Message) {
+	if !isStored(m) || m.From == 0 {
+		return
+	}
+	go func(id uint) {
+		if err := service.AckMessage(id); err != nil {
+			log.Printf("AckMessage error: %v", err)
+		}
+	}(m.ID)
+	ack := &Message{Type: "ack", ID: m.ID}
+	h.deliverUser(m.From, ack)
+	h.publish(userChannel(m.From), ack)
+}
+
+// undeliveredMessages reads the direct messages a user has not acked yet.
+func undeliveredMessages(userID, afterID uint, limit int) ([]model.Message, error) {
+	if global.GVA_DB == nil {
+		return nil, nil
+	}
+	return service.GetUndeliveredMessages(userID, afterID, limit)
+}
+
+// loadOffline reads the direct messages c's user has not acked yet and queues
+// them for replay, oldest first, leaving out those in skip that its resume
+// gap already replays. They are marked delivered when the client acks them.
+func (h *Hub) loadOffline(c *Client, skip map[uint]bool) {
+	var after uint
+	for {
+		stored, err := h.undelivered(c.userID, after, offlineBatch)
+		if err != nil {
+			log.Printf("load offline messages for user %d: %v", c.userID, err)
+			return
+		}
+		if len(stored) == 0 {
+			return
+		}
+		msgs := make([]*Message, 0, len(stored))
+		for i := range stored {
+			if !skip[stored[i].ID] {
+				msgs = append(msgs, messageFromModel(&stored[i]))
+			}
+		}
+		if len(msgs) > 0 {
+			h.unicast <- clientBatch{client: c, msgs: msgs}
+		}
+		if len(stored) < offlineBatch {
+			return
+		}
+		after = stored[len(stored)-1].ID
+	}
+}
+
+// reply queues m for c alone. Safe to call from any goroutine.
+func (h *Hub) reply(c *Client, m *Message) {
+	h.unicast <- clientBatch{client: c, msgs: []*Message{m}}
+}
+
+// send queues m for c, dropping clients whose buffer is full. Frames for a
+// client that is still waiting for its resume gap are held back.
+func (h *Hub) send(c *Client, m *Message) bool {
+	if c.held != nil {
+		if len(c.held) >= maxHeldFrames {
+			h.removeClient(c)
+			return false
+		}
+		c.held = append(c.held, m)
+		return true
+	}
+	select {
+	case c.send <- m:
+		return true
+	default:
+		h.removeClient(c)
+		return false
+	}
+}
+
+// release sends a loaded resume gap to c followed by the frames held back
+// while it was loading.
+func (h *Hub) release(c *Client, msgs []*Message) {
+	msgs = append(msgs, c.held...)
+	c.held = nil
+	for _, m := range msgs {
+		if !h.send(c, m) {
+			return
+		}
+	}
+}
+
+// stamp assigns the next sequence number of uid's session to a copy of m.
+func (h *Hub) stamp(uid uint, m *Message) *Message {
+	if uid == 0 {
+		return m
+	}
+	return h.sessionFor(uid).stamp(m)
+}
+
+// deliverUser sends m to every local client of user uid and reports whether
+// at least one of them accepted it. A user whose clients all left recently
+// still has the frame recorded so it can be resumed.
+func (h *Hub) deliverUser(uid uint, m *Message) bool {
+	if h.applyBlockChange(uid, m) {
+		return false
+	}
+	h.applyMembership(uid, m)
+	if m.Type == "logout" && m.Body != "" {
+		h.logoutSession(uid, m)
+		return false
+	}
+	if m.Type == "logout" {
+		defer h.disconnectUser(uid)
+	}
+	set := h.users[uid]
+	if len(set) == 0 {
+		if s, ok := h.sessions[uid]; ok {
+			s.stamp(m)
+		}
+		if m.Type == "logout" {
+			h.dropSession(uid)
+		}
+		return false
+	}
+	m = h.stamp(uid, m)
+	delivered := false
+	for c := range set {
+		if h.send(c, m) {
+			delivered = true
+		}
+	}
+	return delivered
+}
+
+func (h *Hub) deliverRoom(roomID string, m *Message) {
+	h.deliverEach(h.rooms[roomID], m)
+	for uid := range h.idle[roomID] {
+		h.sessions[uid].stamp(m)
+	}
+}
+
+func (h *Hub) deliverPresence(uid uint, m *Message) {
+	h.deliverEach(h.watchers[uid], m)
+}
+
+func (h *Hub) deliverAll(m *Message) {
+	h.deliverEach(h.clients, m)
+	for _, s := range h.sessions {
+		if !s.idleSince.IsZero() {
+			s.stamp(m)
+		}
+	}
+}
+
+// deliverEach sends m to every client in set, stamping it once per user so
+// all devices of a user see the same sequence number.
+func (h *Hub) deliverEach(set map[*Client]bool, m *Message) {
+	stamped := make(map[uint]*Message)
+	for c := range set {
+		f, ok := stamped[c.userID]
+		if !ok {
+			f = h.stamp(c.userID, m)
+			stamped[c.userID] = f
+		}
+		h.send(c, f)
+	}
+}
+
+// removeClient detaches c from every index and closes its send channel.
+func (h *Hub) removeClient(c *Client) {
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.send)
+	}
+	c.gone = true
+	if c.userID != 0 {
+		if set, ok := h.users[c.userID]; ok && set[c] {
+			delete(set, c)
+			if len(set) == 0 {
+				delete(h.users, c.userID)
+				// the user channel and rooms stay subscribed so the
+				// session records what the user misses until it expires
+				h.park(c.userID, c.rooms)
+			}
+		}
+	}
+	for roomID := range c.rooms {
+		h.leaveRoom(roomID, c)
+	}
+	for uid := range c.watching {
+		h.unwatch(uid, c)
+	}
+}
+
+// Logout closes every connection of uid, on all instances, after sending
+// them a logout frame. It is used when the user's tokens are revoked.
+func (h *Hub) Logout(uid uint) {
+	h.Dispatch(&Message{Type: "logout", To: uid})
+}
+
+// LogoutSession closes the connections of uid made with tokens of session
+// sid, on all instances, after sending them a logout frame.
+func (h *Hub) LogoutSession(uid uint, sid string) {
+	if sid == "" {
+		return
+	}
+	h.Dispatch(&Message{Type: "logout", To: uid, Body: sid})
+}
+
+// logoutSession sends m, without the session id, to the local clients of
+// uid connected with session m.Body and closes them.
+func (h *Hub) logoutSession(uid uint, m *Message) {
+	f := *m
+	f.Body = ""
+	for c := range h.users[uid] {
+		if c.sid == m.Body {
+			if h.send(c, &f) {
+				h.removeClient(c)
+			}
+		}
+	}
+}
+
+// disconnectUser closes the local connections of uid and drops its session.
+// Frames already queued for them, such as the logout frame, are still
+// written.
+func (h *Hub) disconnectUser(uid uint) {
+	for c := range h.users[uid] {
+		h.removeClient(c)
+	}
+	h.dropSession(uid)
+}
+
+// applyMembership joins or removes uid's local clients when m announces a
+// room membership change.
+func (h *Hub) applyMembership(uid uint, m *Message) {
+	if m.RoomID == "" || (m.Type != "room_joined" && m.Type != "room_left") {
+		return
+	}
+	if s, ok := h.sessions[uid]; ok && !s.idleSince.IsZero() {
+		if m.Type == "room_joined" {
+			h.parkRoom(uid, s, m.RoomID)
+		} else {
+			h.unparkRoom(uid, s, m.RoomID)
+		}
+		return
+	}
+	for c := range h.users[uid] {
+		if m.Type == "room_joined" {
+			h.joinRoom(m.RoomID, c)
+		} else {
+			h.leaveRoom(m.RoomID, c)
 		}
 	}
 }
 
 func (h *Hub) joinRoom(roomID string, c *Client) {
+	if c.gone {
+		return
+	}
 	if _, ok := h.rooms[roomID]; !ok {
 		h.rooms[roomID] = make(map[*Client]bool)
-		// ensure redis subscription for room channel
-		h.ensureSub(fmt.Sprintf("room:%s", roomID))
+		// ensure broker subscription for room channel
+		h.ensureSub(roomChannel(roomID))
 	}
 	h.rooms[roomID][c] = true
+	c.rooms[roomID] = true
 	log.Printf("client user=%d joined room=%s", c.userID, roomID)
 }
 
 func (h *Hub) leaveRoom(roomID string, c *Client) {
+	delete(c.rooms, roomID)
 	if set, ok := h.rooms[roomID]; ok {
 		delete(set, c)
 		if len(set) == 0 {
 			delete(h.rooms, roomID)
-			// remove redis subscription when no local clients
-			h.removeSub(fmt.Sprintf("room:%s", roomID))
+			// remove broker subscription when no local clients or idle
+			// sessions need it
+			if len(h.idle[roomID]) == 0 {
+				h.removeSub(roomChannel(roomID))
+			}
 		}
 		log.Printf("client user=%d left room=%s", c.userID, roomID)
 	}
 }
 
-// RedisSub holds pubsub and cancel function
-type RedisSub struct {
-	channel string
-	cancel  context.CancelFunc
+func (h *Hub) watch(uid uint, c *Client) {
+	if c.gone {
+		return
+	}
+	if _, ok := h.watchers[uid]; !ok {
+		h.watchers[uid] = make(map[*Client]bool)
+		h.ensureSub(presenceChannel(uid))
+	}
+	h.watchers[uid][c] = true
+	c.watching[uid] = true
+}
+
+func (h *Hub) unwatch(uid uint, c *Client) {
+	delete(c.watching, uid)
+	if set, ok := h.watchers[uid]; ok {
+		delete(set, c)
+		if len(set) == 0 {
+			delete(h.watchers, uid)
+			h.removeSub(presenceChannel(uid))
+		}
+	}
 }
 
 func (h *Hub) ensureSub(channel string) {
-	if global.GVA_REDIS == nil {
+	if h.broker == nil || h.subs[channel] {
 		return
 	}
-	h.subsMu.Lock()
-	defer h.subsMu.Unlock()
-	if _, ok := h.subs[channel]; ok {
+	if err := h.broker.Subscribe(channel, h.receive); err != nil {
+		log.Printf("broker subscribe %s error: %v", channel, err)
 		return
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	pubsub := global.GVA_REDIS.Subscribe(ctx, channel)
-	h.subs[channel] = &RedisSub{channel: channel, cancel: cancel}
-	ch := pubsub.Channel()
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				_ = pubsub.Close()
-				return
-			case msg, ok := <-ch:
-				if !ok {
-					return
-				}
-				var m Message
-				if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
-					log.Printf("redis unmarshal error: %v", err)
-					continue
-				}
-				// deliver to local clients for target user
-				if strings.HasPrefix(msg.Channel, "user:") && m.Type == "ack" {
-					// channel owner id
-					parts := strings.Split(msg.Channel, ":")
-					if len(parts) == 2 {
-						if uid, err := strconv.ParseUint(parts[1], 10, 64); err == nil {
-							owner := uint(uid)
-							// mark ack in DB
-							if m.ID != 0 {
-								if err := service.AckMessage(m.ID); err != nil {
-									log.Printf("AckMessage error from redis ack: %v", err)
-								}
-							}
-							// deliver ack to local owner clients
-							if set, ok := h.users[owner]; ok {
-								for c := range set {
-									select {
-									case c.send <- &m:
-									default:
-										close(c.send)
-										delete(h.clients, c)
-									}
-								}
-							}
-						}
-					}
-				} else if strings.HasPrefix(msg.Channel, "room:") {
-					// deliver to local room clients
-					roomID := strings.TrimPrefix(msg.Channel, "room:")
-					if set, ok := h.rooms[roomID]; ok {
-						for c := range set {
-							select {
-							case c.send <- &m:
-							default:
-								close(c.send)
-								delete(h.clients, c)
-							}
-						}
-					}
-				} else {
-					// deliver to local clients for target user
-					if m.To != 0 {
-						if set, ok := h.users[m.To]; ok {
-							deliveredLocal := false
-							for c := range set {
-								select {
-								case c.send <- &m:
-									deliveredLocal = true
-								default:
-									close(c.send)
-									delete(h.clients, c)
-								}
-							}
-							if deliveredLocal {
-								// notify sender via redis ack so origin marks delivered
-								if m.ID != 0 && m.From != 0 && global.GVA_REDIS != nil {
-									ack := &Message{Type: "ack", ID: m.ID}
-									b, _ := json.Marshal(ack)
-									if err := global.GVA_REDIS.Publish(context.Background(), fmt.Sprintf("user:%d", m.From), string(b)).Err(); err != nil {
-										log.Printf("redis publish ack error: %v", err)
-									}
-								}
-							}
-						}
-					} else {
-						// global broadcast
-						for c := range h.clients {
-							select {
-							case c.send <- &m:
-							default:
-								close(c.send)
-								delete(h.clients, c)
-							}
-						}
-					}
-				}
-			}
-		}
-	}()
+	h.subs[channel] = true
 }
 
 func (h *Hub) removeSub(channel string) {
-	if global.GVA_REDIS == nil {
+	if h.broker == nil || !h.subs[channel] {
 		return
 	}
-	h.subsMu.Lock()
-	defer h.subsMu.Unlock()
-	if s, ok := h.subs[channel]; ok {
-		s.cancel()
-		delete(h.subs, channel)
+	if err := h.broker.Unsubscribe(channel); err != nil {
+		log.Printf("broker unsubscribe %s error: %v", channel, err)
 	}
+	delete(h.subs, channel)
 }
 
-func (h *Hub) publishToRedis(m *Message) {
-	if global.GVA_REDIS == nil {
+// receive is the broker handler. It runs on the broker's goroutine, hands
+// frames from other instances to Run and returns once they were delivered
+// locally, so acknowledging brokers never ack a frame that was not handled.
+func (h *Hub) receive(channel string, payload []byte) {
+	var e envelope
+	if err := json.Unmarshal(payload, &e); err != nil {
+		log.Printf("broker unmarshal error: %v", err)
 		return
 	}
-	var channel string
-	if m.RoomID != "" {
-		channel = fmt.Sprintf("room:%s", m.RoomID)
-	} else if m.To != 0 {
-		channel = fmt.Sprintf("user:%d", m.To)
-	} else {
-		channel = "broadcast"
-	}
-	b, err := json.Marshal(m)
-	if err != nil {
-		log.Printf("redis marshal error: %v", err)
+	if e.Origin == h.id || e.Msg == nil {
 		return
 	}
-	if err := global.GVA_REDIS.Publish(context.Background(), channel, string(b)).Err(); err != nil {
-		log.Printf("redis publish error: %v", err)
+	if h.dropBlocked(channel, e.Msg) {
+		return
 	}
+	e.Channel = channel
+	e.done = make(chan struct{})
+	h.remote <- &e
+	<-e.done
 }
 
-func init() {
-	go DefaultHub.Run()
+// publish hands m to the broker so other instances can deliver it.
+func (h *Hub) publish(channel string, m *Message) {
+	if h.broker == nil {
+		return
+	}
+	b, err := json.Marshal(&envelope{Origin: h.id, Msg: m})
+	if err != nil {
+		log.Printf("broker marshal error: %v", err)
+		return
+	}
+	go func() {
+		if err := h.broker.Publish(context.Background(), channel, b); err != nil {
+			log.Printf("broker publish %s error: %v", channel, err)
+		}
+	}()
 }
@@ -1,12 +1,17 @@
 package ws
 
 import (
+	"sync"
 	"testing"
 	"time"
+
+	"chat/model"
+
+	"gorm.io/gorm"
 )
 
 func TestHubDirectMessage(t *testing.T) {
-	h := NewHub()
+	h := NewHub(nil)
 	go h.Run()
 
 	c := NewClient(h, nil, 42)
@@ -30,7 +35,7 @@ func TestHubDirectMessage(t *testing.T) {
 }
 
 func TestHubBroadcast(t *testing.T) {
-	h := NewHub()
+	h := NewHub(nil)
 	go h.Run()
 
 	c1 := NewClient(h, nil, 1)
@@ -55,3 +60,398 @@ func TestHubBroadcast(t *testing.T) {
 		}
 	}
 }
+
+// newBusHubs starts n hubs that share one in-memory bus.
+func newBusHubs(n int) []*Hub {
+	bus := NewMemoryBus()
+	hubs := make([]*Hub, n)
+	for i := range hubs {
+		hubs[i] = NewHub(NewMemoryBroker(bus))
+		go hubs[i].Run()
+	}
+	return hubs
+}
+
+func expectBody(t *testing.T, c *Client, body string) {
+	t.Helper()
+	select {
+	case got := <-c.send:
+		if got.Body != body {
+			t.Fatalf("expected body '%s', got '%s'", body, got.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for '%s'", body)
+	}
+}
+
+func expectNothing(t *testing.T, c *Client) {
+	t.Helper()
+	select {
+	case got := <-c.send:
+		t.Fatalf("unexpected message %+v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBrokerDirectMessageAcrossHubs(t *testing.T) {
+	hubs := newBusHubs(2)
+
+	c := NewClient(hubs[1], nil, 42)
+	hubs[1].register <- c
+	time.Sleep(10 * time.Millisecond)
+
+	hubs[0].broadcast <- &Message{Type: "message", From: 1, To: 42, Body: "remote hello"}
+	expectBody(t, c, "remote hello")
+	expectNothing(t, c)
+}
+
+func TestBrokerRoomAcrossHubs(t *testing.T) {
+	hubs := newBusHubs(2)
+
+	local := NewClient(hubs[0], nil, 1)
+	remote := NewClient(hubs[1], nil, 2)
+	outsider := NewClient(hubs[1], nil, 3)
+	hubs[0].register <- local
+	hubs[1].register <- remote
+	hubs[1].register <- outsider
+	hubs[0].roomOps <- roomOp{client: local, roomID: "general", join: true}
+	hubs[1].roomOps <- roomOp{client: remote, roomID: "general", join: true}
+	time.Sleep(10 * time.Millisecond)
+
+	hubs[0].broadcast <- &Message{Type: "message", From: 1, RoomID: "general", Body: "standup"}
+	expectBody(t, local, "standup")
+	expectBody(t, remote, "standup")
+	expectNothing(t, local)
+	expectNothing(t, outsider)
+}
+
+func TestBrokerBroadcastAcrossHubs(t *testing.T) {
+	hubs := newBusHubs(3)
+
+	clients := make([]*Client, len(hubs))
+	for i, h := range hubs {
+		clients[i] = NewClient(h, nil, uint(i+1))
+		h.register <- clients[i]
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	hubs[2].broadcast <- &Message{Type: "message", Body: "everyone"}
+	for _, c := range clients {
+		expectBody(t, c, "everyone")
+		expectNothing(t, c)
+	}
+}
+
+func TestBrokerPresenceAcrossHubs(t *testing.T) {
+	hubs := newBusHubs(2)
+
+	watcher := NewClient(hubs[1], nil, 2)
+	other := NewClient(hubs[1], nil, 3)
+	hubs[1].register <- watcher
+	hubs[1].register <- other
+	hubs[1].watchOps <- watchOp{client: watcher, userID: 1, watch: true}
+	time.Sleep(10 * time.Millisecond)
+
+	hubs[0].Dispatch(&Message{Type: "presence", From: 1, Body: "away"})
+	expectBody(t, watcher, "away")
+	expectNothing(t, other)
+
+	hubs[1].watchOps <- watchOp{client: watcher, userID: 1}
+	time.Sleep(10 * time.Millisecond)
+	hubs[0].Dispatch(&Message{Type: "presence", From: 1, Body: "online"})
+	expectNothing(t, watcher)
+}
+
+func TestHubResumeFromSequence(t *testing.T) {
+	h := NewHub(nil)
+	go h.Run()
+
+	first := NewClient(h, nil, 5)
+	h.register <- first
+	time.Sleep(10 * time.Millisecond)
+	for _, body := range []string{"one", "two", "three"} {
+		h.broadcast <- &Message{Type: "message", To: 5, Body: body}
+	}
+	var last uint64
+	for _, body := range []string{"one", "two", "three"} {
+		select {
+		case got := <-first.send:
+			if got.Body != body || got.Seq != last+1 {
+				t.Fatalf("expected %s with seq %d, got %+v", body, last+1, got)
+			}
+			last = got.Seq
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for direct message")
+		}
+	}
+	h.unregister <- first
+
+	// reconnect having only seen the first frame
+	second := NewClient(h, nil, 5)
+	second.resumeFrom = 1
+	h.register <- second
+	expectBody(t, second, "two")
+	expectBody(t, second, "three")
+	expectNothing(t, second)
+
+	// a sequence this hub never issued forces a resync
+	third := NewClient(h, nil, 5)
+	third.resumeFrom = 99
+	h.register <- third
+	select {
+	case got := <-third.send:
+		if got.Type != "resync" {
+			t.Fatalf("expected resync, got %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for resync")
+	}
+}
+
+func TestResumeCoversRoomFramesWhileAway(t *testing.T) {
+	hubs := newBusHubs(2)
+
+	away := NewClient(hubs[1], nil, 5)
+	away.autoRooms = []string{"general"}
+	hubs[1].register <- away
+	time.Sleep(10 * time.Millisecond)
+	hubs[1].Dispatch(&Message{Type: "message", To: 5, Body: "hello"})
+	expectBody(t, away, "hello")
+	// typing frames take no sequence number
+	hubs[1].Dispatch(&Message{Type: "typing_start", From: 6, RoomID: "general"})
+	select {
+	case got := <-away.send:
+		if got.Type != "typing_start" || got.Seq != 0 {
+			t.Fatalf("expected unsequenced typing_start, got %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for typing_start")
+	}
+	hubs[1].unregister <- away
+	time.Sleep(10 * time.Millisecond)
+
+	// sent from another instance while user 5 has no connection
+	hubs[0].Dispatch(&Message{Type: "message", From: 6, RoomID: "general", Body: "standup"})
+	hubs[0].Dispatch(&Message{Type: "typing_stop", From: 6, RoomID: "general"})
+	hubs[0].Dispatch(&Message{Type: "message", Body: "everyone"})
+	time.Sleep(20 * time.Millisecond)
+
+	back := NewClient(hubs[1], nil, 5)
+	back.resumeFrom = 1
+	hubs[1].register <- back
+	got := map[string]uint64{}
+	for len(got) < 2 {
+		select {
+		case m := <-back.send:
+			got[m.Body] = m.Seq
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for missed frames, got %v", got)
+		}
+	}
+	if got["standup"] < 2 || got["everyone"] < 2 || got["standup"] == got["everyone"] {
+		t.Fatalf("expected the room and broadcast frames with seq 2 and 3, got %v", got)
+	}
+	expectNothing(t, back)
+}
+
+func TestResumeDoesNotReplayOfflineMessagesTwice(t *testing.T) {
+	var mu sync.Mutex
+	var pending []model.Message
+	h := NewHub(nil)
+	h.undelivered = func(userID, afterID uint, limit int) ([]model.Message, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		var out []model.Message
+		for _, m := range pending {
+			if m.To == userID && m.ID > afterID {
+				out = append(out, m)
+			}
+		}
+		return out, nil
+	}
+	go h.Run()
+
+	first := NewClient(h, nil, 5)
+	h.register <- first
+	time.Sleep(10 * time.Millisecond)
+	h.Dispatch(&Message{Type: "message", To: 5, Body: "hello"})
+	expectBody(t, first, "hello")
+	h.unregister <- first
+	time.Sleep(10 * time.Millisecond)
+
+	// stored and sent while user 5 is away, so it is in the parked
+	// session and still unacked
+	missed := model.Message{Model: gorm.Model{ID: 9}, Type: "message", From: 6, To: 5, Body: "missed"}
+	mu.Lock()
+	// sent before this session began; only the offline replay has it
+	pending = append(pending, model.Message{Model: gorm.Model{ID: 8}, Type: "message", From: 6, To: 5, Body: "earlier"}, missed)
+	mu.Unlock()
+	h.Dispatch(messageFromModel(&missed))
+	time.Sleep(10 * time.Millisecond)
+
+	back := NewClient(h, nil, 5)
+	back.resumeFrom = 1
+	h.register <- back
+	got := map[string]int{}
+	for len(got) < 2 {
+		select {
+		case m := <-back.send:
+			got[m.Body]++
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for replayed messages, got %v", got)
+		}
+	}
+	expectNothing(t, back)
+	if got["missed"] != 1 || got["earlier"] != 1 {
+		t.Fatalf("expected each message once, got %v", got)
+	}
+}
+
+func TestTypingThrottledAndStopped(t *testing.T) {
+	h := NewHub(nil)
+	go h.Run()
+
+	typist := NewClient(h, nil, 1)
+	peer := NewClient(h, nil, 2)
+	h.register <- typist
+	h.register <- peer
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		typist.typing(&Message{Type: "typing_start", To: 2})
+	}
+	expectType(t, peer, "typing_start")
+	expectNothing(t, peer)
+
+	// a disconnecting typist stops its indicators
+	typist.stopTyping()
+	expectType(t, peer, "typing_stop")
+	typist.typing(&Message{Type: "typing_stop", To: 2})
+	expectNothing(t, peer)
+}
+
+func TestTypingSharedByUserConnections(t *testing.T) {
+	h := NewHub(nil)
+	go h.Run()
+
+	phone := NewClient(h, nil, 1)
+	laptop := NewClient(h, nil, 1)
+	peer := NewClient(h, nil, 2)
+	for _, c := range []*Client{phone, laptop, peer} {
+		h.register <- c
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// both devices typing count as one sender
+	phone.typing(&Message{Type: "typing_start", To: 2})
+	laptop.typing(&Message{Type: "typing_start", To: 2})
+	expectType(t, peer, "typing_start")
+	expectNothing(t, peer)
+
+	// one device leaving keeps the other's indicator up
+	phone.stopTyping()
+	expectNothing(t, peer)
+
+	// a stop from either device ends it
+	phone.typing(&Message{Type: "typing_start", To: 2})
+	phone.typing(&Message{Type: "typing_stop", To: 2})
+	expectType(t, peer, "typing_stop")
+	laptop.stopTyping()
+	expectNothing(t, peer)
+}
+
+func expectType(t *testing.T, c *Client, typ string) {
+	t.Helper()
+	select {
+	case got := <-c.send:
+		if got.Type != typ {
+			t.Fatalf("expected %q frame, got %q", typ, got.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for %q", typ)
+	}
+}
+
+func TestDispatchChangeReachesBothSides(t *testing.T) {
+	h := NewHub(nil)
+	go h.Run()
+
+	sender := NewClient(h, nil, 1)
+	peer := NewClient(h, nil, 2)
+	h.register <- sender
+	h.register <- peer
+	time.Sleep(10 * time.Millisecond)
+
+	h.DispatchChange("edit", &model.Message{Model: gorm.Model{ID: 7}, From: 1, To: 2, Body: "fixed"})
+	expectBody(t, peer, "fixed")
+	expectBody(t, sender, "fixed")
+	// an edit is not a new message, so the sender gets no delivery ack
+	expectNothing(t, sender)
+}
+
+func TestDropWatchesAcrossHubs(t *testing.T) {
+	hubs := newBusHubs(2)
+
+	watcher := NewClient(hubs[1], nil, 2)
+	hubs[1].register <- watcher
+	hubs[1].watchOps <- watchOp{client: watcher, userID: 1, watch: true}
+	time.Sleep(10 * time.Millisecond)
+
+	// the watch works before the block
+	hubs[0].Dispatch(&Message{Type: "presence", From: 1, Body: "online"})
+	expectBody(t, watcher, "online")
+
+	// user 1 blocks user 2 on the other instance
+	hubs[0].DropWatches(1, 2)
+	time.Sleep(10 * time.Millisecond)
+	hubs[0].Dispatch(&Message{Type: "presence", From: 1, Body: "away"})
+	// the internal frame is not delivered either
+	expectNothing(t, watcher)
+}
+
+func TestBlockCacheForgetsChangedPairs(t *testing.T) {
+	h := NewHub(nil)
+	go h.Run()
+
+	c := NewClient(h, nil, 2)
+	h.register <- c
+	time.Sleep(10 * time.Millisecond)
+
+	h.blocks.mu.Lock()
+	h.blocks.entries[pairKey(1, 2)] = blockEntry{blocked: true, expires: time.Now().Add(time.Minute)}
+	h.blocks.mu.Unlock()
+	if !h.dropBlocked("user:2", &Message{Type: "message", ID: 1, From: 1, To: 2}) {
+		t.Fatal("expected the cached block to drop the frame")
+	}
+	h.Unblocked(1, 2)
+	expectNothing(t, c)
+	h.blocks.mu.Lock()
+	_, cached := h.blocks.entries[pairKey(1, 2)]
+	h.blocks.mu.Unlock()
+	if cached {
+		t.Fatal("expected unblocking to forget the cached check")
+	}
+}
+
+func TestLogoutClosesUserConnections(t *testing.T) {
+	h := NewHub(nil)
+	go h.Run()
+
+	c := NewClient(h, nil, 1)
+	other := NewClient(h, nil, 2)
+	h.register <- c
+	h.register <- other
+	time.Sleep(10 * time.Millisecond)
+
+	h.Logout(1)
+	expectType(t, c, "logout")
+	select {
+	case _, ok := <-c.send:
+		if ok {
+			t.Fatal("expected the send channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the connection to close")
+	}
+	expectNothing(t, other)
+}
@@ -0,0 +1,240 @@
+package ws
+
+import (
+	"log"
+	"time"
+
+	"chat/global"
+	"chat/service"
+)
+
+const (
+	// Frames kept per user for resuming from memory.
+	sessionFrames = 256
+
+	// Sequence -> message id references kept after frames are trimmed, used
+	// to refill older gaps from the database.
+	sessionRefs = 4096
+
+	// How long a session outlives the last local client of its user.
+	sessionTTL = 10 * time.Minute
+
+	// Frames a resuming client may accumulate while its gap is loaded.
+	maxHeldFrames = 1024
+)
+
+// session tracks the outbound sequence of one user on this instance. Every
+// frame delivered to the user gets the next sequence number; the most recent
+// frames are kept so a reconnecting client can ask for exactly what it missed.
+type session struct {
+	seq    uint64
+	frames []*Message
+	refs   []seqRef
+
+	// zero while the user has local clients
+	idleSince time.Time
+	// rooms the user's clients were in when the last one left; frames to
+	// them are still recorded while the session is idle
+	rooms map[string]bool
+}
+
+// seqRef remembers which stored message a trimmed frame carried.
+type seqRef struct {
+	seq uint64
+	id  uint
+}
+
+// stamp returns a copy of m carrying the next sequence number and records it.
+// Ephemeral frames are returned as they are.
+func (s *session) stamp(m *Message) *Message {
+	if ephemeralTypes[m.Type] {
+		return m
+	}
+	s.seq++
+	cp := *m
+	cp.Seq = s.seq
+	s.frames = append(s.frames, &cp)
+	if len(s.frames) > sessionFrames {
+		old := s.frames[0]
+		s.frames = s.frames[1:]
+		if isStored(old) {
+			s.refs = append(s.refs, seqRef{seq: old.Seq, id: old.ID})
+			if len(s.refs) > sessionRefs {
+				s.refs = s.refs[1:]
+			}
+		}
+	}
+	return &cp
+}
+
+// since returns the buffered frames after seq and the stored message ids,
+// keyed by sequence, of trimmed frames after seq. complete is false when
+// part of the gap is no longer known.
+func (s *session) since(seq uint64) (frames []*Message, refs []seqRef, complete bool) {
+	oldest := s.seq + 1
+	if len(s.frames) > 0 {
+		oldest = s.frames[0].Seq
+	}
+	complete = seq+1 >= oldest
+	if !complete {
+		// frames between seq and oldest were trimmed; only those that
+		// carried stored messages can be recovered
+		complete = len(s.refs) > 0 && seq+1 >= s.refs[0].seq
+		for _, r := range s.refs {
+			if r.seq > seq {
+				refs = append(refs, r)
+			}
+		}
+	}
+	for _, f := range s.frames {
+		if f.Seq > seq {
+			frames = append(frames, f)
+		}
+	}
+	return frames, refs, complete
+}
+
+// sessionFor returns the session of uid, creating it if needed.
+func (h *Hub) sessionFor(uid uint) *session {
+	s, ok := h.sessions[uid]
+	if !ok {
+		s = &session{}
+		h.sessions[uid] = s
+	}
+	return s
+}
+
+// resume replays to c the frames its user was sent after c.resumeFrom and
+// returns the ids of the stored messages among them, which the offline
+// replay must not send again.
+func (h *Hub) resume(c *Client) map[uint]bool {
+	s, ok := h.sessions[c.userID]
+	if !ok || c.resumeFrom > s.seq {
+		// the sequence the client knows is not from this session; it must
+		// reload its state and start counting again
+		h.send(c, &Message{Type: "resync"})
+		return nil
+	}
+	frames, refs, complete := s.since(c.resumeFrom)
+	replayed := make(map[uint]bool)
+	for _, f := range frames {
+		if isStored(f) {
+			replayed[f.ID] = true
+		}
+	}
+	if len(refs) == 0 || global.GVA_DB == nil {
+		for _, f := range frames {
+			if !h.send(c, f) {
+				return replayed
+			}
+		}
+		if !complete || len(refs) > 0 {
+			h.send(c, &Message{Type: "resync"})
+		}
+		return replayed
+	}
+	for _, r := range refs {
+		replayed[r.id] = true
+	}
+	// hold live frames until the trimmed part of the gap is loaded
+	c.held = []*Message{}
+	go h.loadGap(c, refs, frames, complete)
+	return replayed
+}
+
+// loadGap reads the stored messages behind refs and queues them, followed by
+// the buffered frames, for replay to c.
+func (h *Hub) loadGap(c *Client, refs []seqRef, frames []*Message, complete bool) {
+	ids := make([]uint, len(refs))
+	seqs := make(map[uint]uint64, len(refs))
+	for i, r := range refs {
+		ids[i] = r.id
+		seqs[r.id] = r.seq
+	}
+	var msgs []*Message
+	stored, err := service.GetMessagesByIDs(ids)
+	if err != nil {
+		log.Printf("load resume gap for user %d: %v", c.userID, err)
+		complete = false
+	}
+	for i := range stored {
+		m := messageFromModel(&stored[i])
+		m.Seq = seqs[m.ID]
+		msgs = append(msgs, m)
+	}
+	msgs = append(msgs, frames...)
+	if !complete {
+		msgs = append(msgs, &Message{Type: "resync"})
+	}
+	h.unicast <- clientBatch{client: c, msgs: msgs, release: true}
+}
+
+// park keeps recording frames for uid after its last local client left:
+// the user channel stays subscribed and rooms are remembered so their frames
+// are stamped until the user comes back or the session expires.
+func (h *Hub) park(uid uint, rooms map[string]bool) {
+	s := h.sessionFor(uid)
+	s.idleSince = time.Now()
+	s.rooms = make(map[string]bool, len(rooms))
+	for roomID := range rooms {
+		h.parkRoom(uid, s, roomID)
+	}
+}
+
+func (h *Hub) parkRoom(uid uint, s *session, roomID string) {
+	s.rooms[roomID] = true
+	if _, ok := h.idle[roomID]; !ok {
+		h.idle[roomID] = make(map[uint]bool)
+		h.ensureSub(roomChannel(roomID))
+	}
+	h.idle[roomID][uid] = true
+}
+
+func (h *Hub) unparkRoom(uid uint, s *session, roomID string) {
+	delete(s.rooms, roomID)
+	if set, ok := h.idle[roomID]; ok {
+		delete(set, uid)
+		if len(set) == 0 {
+			delete(h.idle, roomID)
+			if len(h.rooms[roomID]) == 0 {
+				h.removeSub(roomChannel(roomID))
+			}
+		}
+	}
+}
+
+// unpark ends the idle period of uid's session when a client comes back.
+func (h *Hub) unpark(uid uint) {
+	s := h.sessionFor(uid)
+	for roomID := range s.rooms {
+		h.unparkRoom(uid, s, roomID)
+	}
+	s.rooms = nil
+	s.idleSince = time.Time{}
+}
+
+// dropSession forgets uid's session and the subscriptions kept for it.
+// Clients resuming it afterwards are told to resync.
+func (h *Hub) dropSession(uid uint) {
+	s, ok := h.sessions[uid]
+	if !ok {
+		return
+	}
+	for roomID := range s.rooms {
+		h.unparkRoom(uid, s, roomID)
+	}
+	delete(h.sessions, uid)
+	if len(h.users[uid]) == 0 {
+		h.removeSub(userChannel(uid))
+	}
+}
+
+// expireSessions drops sessions whose user has had no local client for
+// longer than sessionTTL.
+func (h *Hub) expireSessions(now time.Time) {
+	for uid, s := range h.sessions {
+		if !s.idleSince.IsZero() && now.Sub(s.idleSince) > sessionTTL {
+			h.dropSession(uid)
+		}
+	}
+}
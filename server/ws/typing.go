@@ -0,0 +1,122 @@
+package ws
+
+import (
+	"sync"
+	"time"
+
+	"chat/service"
+)
+
+const (
+	// Minimum interval between typing_start frames forwarded for the same
+	// sender and conversation; repeats in between only extend the timeout.
+	typingThrottle = 2 * time.Second
+
+	// A typing indicator without a fresh typing_start is stopped after this.
+	typingTimeout = 6 * time.Second
+)
+
+// typingTarget is the conversation a typing indicator belongs to.
+type typingTarget struct {
+	to   uint
+	room string
+}
+
+// typingKey names the indicator of one sender in one conversation.
+type typingKey struct {
+	from uint
+	typingTarget
+}
+
+type typingState struct {
+	sent  time.Time
+	timer *time.Timer
+	// connections of the sender that are typing
+	clients map[*Client]bool
+}
+
+// typingStates holds the typing indicators started through a hub, shared by
+// all connections of a sender.
+type typingStates struct {
+	mu     sync.Mutex
+	states map[typingKey]*typingState
+}
+
+func newTypingStates() *typingStates {
+	return &typingStates{states: make(map[typingKey]*typingState)}
+}
+
+// typing handles a typing_start or typing_stop frame from c. Indicators are
+// never stored; starts are throttled per sender and conversation across all
+// of the sender's connections, and every started indicator is eventually
+// followed by a typing_stop, sent by the server if the client does not.
+func (c *Client) typing(m *Message) {
+	t := typingTarget{to: m.To, room: m.RoomID}
+	if t.room != "" {
+		t.to = 0
+	}
+	k := typingKey{from: c.userID, typingTarget: t}
+	ts := c.hub.typing
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	st := ts.states[k]
+	if m.Type == "typing_stop" {
+		if st != nil {
+			c.hub.endTyping(k, st)
+		}
+		return
+	}
+	if st == nil {
+		if t.room != "" {
+			if err := service.CheckRoomMember(t.room, c.userID); err != nil {
+				c.hub.reply(c, &Message{Type: "error", RoomID: t.room, Body: err.Error()})
+				return
+			}
+		} else if blocked(c.userID, t.to) {
+			// dropped without telling the typist
+			return
+		}
+		st = &typingState{clients: make(map[*Client]bool)}
+		st.timer = time.AfterFunc(typingTimeout, func() {
+			ts.mu.Lock()
+			defer ts.mu.Unlock()
+			if ts.states[k] == st {
+				c.hub.endTyping(k, st)
+			}
+		})
+		ts.states[k] = st
+	} else {
+		st.timer.Reset(typingTimeout)
+	}
+	st.clients[c] = true
+	if now := time.Now(); now.Sub(st.sent) >= typingThrottle {
+		st.sent = now
+		c.hub.Dispatch(&Message{Type: "typing_start", From: c.userID, To: t.to, RoomID: t.room})
+	}
+}
+
+// endTyping forwards typing_stop for k and forgets its state. The caller
+// holds h.typing.mu.
+func (h *Hub) endTyping(k typingKey, st *typingState) {
+	st.timer.Stop()
+	delete(h.typing.states, k)
+	h.Dispatch(&Message{Type: "typing_stop", From: k.from, To: k.to, RoomID: k.room})
+}
+
+// stopTyping ends the indicators only c was keeping up, used when it
+// disconnects. Those another connection of the user also started stay on
+// until it stops or they time out.
+func (c *Client) stopTyping() {
+	ts := c.hub.typing
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for k, st := range ts.states {
+		if k.from != c.userID || !st.clients[c] {
+			continue
+		}
+		delete(st.clients, c)
+		if len(st.clients) == 0 {
+			c.hub.endTyping(k, st)
+		}
+	}
+}